@@ -7,24 +7,41 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"text/template"
+	"text/template/parse"
 	"time"
 
 	"golang.org/x/net/websocket"
@@ -32,10 +49,293 @@ import (
 
 const wsctlVersion = "1.0"
 
+// exit codes for failures to receive data
+const (
+	exitCodeClosed  = 3
+	exitCodeTimeout = 4
+	exitCodeExpect  = 5
+	exitCodeCommand = 6
+)
+
+// maximum number of followed sip redirects
+const sipMaxRedirects = 5
+
+// underlying network connection of the websocket
+var wsconn net.Conn
+
+// http response of the websocket handshake
+var wsresponse *http.Response
+
+// last data sent over the websocket connection
+var lastSent []byte
+
+// use ansi colors for printed sip messages
+var colorOutput = false
+
+// ansi color codes for printed sip messages
+const (
+	ansiReset  = "\x1b[0m"
+	ansiBold   = "\x1b[1m"
+	ansiRed    = "\x1b[1;31m"
+	ansiCyan   = "\x1b[36m"
+	ansiYellow = "\x1b[33m"
+)
+
+// sip headers by their compact form
+var sipCompactHeaders = map[string]string{
+	"b": "Referred-By",
+	"c": "Content-Type",
+	"e": "Content-Encoding",
+	"f": "From",
+	"i": "Call-ID",
+	"k": "Supported",
+	"l": "Content-Length",
+	"m": "Contact",
+	"o": "Event",
+	"r": "Refer-To",
+	"s": "Subject",
+	"t": "To",
+	"u": "Allow-Events",
+	"v": "Via",
+	"x": "Session-Expires",
+}
+
+// headers that must be in a sip request (all but Max-Forwards in responses)
+var sipMandatoryHeaders = []string{"To", "From", "CSeq", "Call-ID", "Via", "Max-Forwards"}
+
+// levels of the printed messages
+const (
+	logLevelDebug = iota
+	logLevelInfo
+	logLevelWarn
+	logLevelError
+)
+
+var logLevels = map[string]int{
+	"debug": logLevelDebug,
+	"info":  logLevelInfo,
+	"warn":  logLevelWarn,
+	"error": logLevelError,
+}
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+var logLevel = logLevelInfo
+
+// hash functions for the digest auth algorithms
+var digestHashes = map[string]func() hash.Hash{
+	"MD5":         md5.New,
+	"SHA-256":     sha256.New,
+	"SHA-512-256": sha512.New512_256,
+}
+
+// preference order of the digest algorithms when the server offers many
+// challenges - the strongest first
+var authPreference = []string{"SHA-512-256-SESS", "SHA-512-256", "SHA-256-SESS", "SHA-256", "MD5-SESS", "MD5"}
+
+// tls versions by their common name
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tls renegotiation modes
+var tlsRenegotiations = map[string]tls.RenegotiationSupport{
+	"never":  tls.RenegotiateNever,
+	"once":   tls.RenegotiateOnceAsClient,
+	"freely": tls.RenegotiateFreelyAsClient,
+}
+
+// sip options template for healthcheck mode
+const healthcheckTemplate = "OPTIONS sip:{{.sipdomain}} SIP/2.0\r\n" +
+	"Via: SIP/2.0/WSS wsctl.invalid;branch=z9hG4bK%[1]s\r\n" +
+	"Max-Forwards: 70\r\n" +
+	"From: <sip:healthcheck@{{.sipdomain}}>;tag=%[1]s\r\n" +
+	"To: <sip:{{.sipdomain}}>\r\n" +
+	"Call-ID: %[1]s@wsctl.invalid\r\n" +
+	"CSeq: 1 OPTIONS\r\n" +
+	"Content-Length: 0\r\n" +
+	"\r\n"
+
+// delimiters of the template actions
+var tplDelimLeft = "{{"
+var tplDelimRight = "}}"
+
+// correlation id of the run, sent in handshake and sip requests
+var correlationID string
+
+// expectations for the response, from command line options
+var expectMatch *regexp.Regexp
+var expectNotMatch *regexp.Regexp
+var expectRules []ExpectRule
+var expectFile []byte
+
+// sip response classes (like '4xx') or codes stopping the execution
+var failOnCodes []string
+
+// headers (lower case, long and compact names) skipped when comparing the
+// response with the expect file
+var diffIgnoreHeaders = map[string]bool{}
+
+// operators of the expect rules - the ones with two characters first
+var expectOperators = []string{"==", "!=", ">=", "<=", "~=", "!~", ">", "<"}
+
+//
+// ExpectRule - check of the response given with --expect, like 'status==200'
+// or 'header:Contact~=transport=ws'
+type ExpectRule struct {
+	text    string
+	subject string
+	hname   string
+	op      string
+	value   string
+	re      *regexp.Regexp
+}
+
+//
+// RunStats - counters of the execution, printed at the end with --summary
+type RunStats struct {
+	mu      sync.Mutex
+	start   time.Time
+	msent   int
+	bsent   int
+	mrecv   int
+	brecv   int
+	authchl int
+	retries int
+}
+
+var stats = RunStats{start: time.Now()}
+
+//
+// AddSent - count a sent message
+func (st *RunStats) AddSent(n int) {
+	st.mu.Lock()
+	st.msent++
+	st.bsent += n
+	st.mu.Unlock()
+}
+
+//
+// AddRecv - count a received message
+func (st *RunStats) AddRecv(n int) {
+	st.mu.Lock()
+	st.mrecv++
+	st.brecv += n
+	st.mu.Unlock()
+}
+
+//
+// AddAuthChallenge - count a handled authentication challenge
+func (st *RunStats) AddAuthChallenge() {
+	st.mu.Lock()
+	st.authchl++
+	st.mu.Unlock()
+}
+
+//
+// AddRetry - count a resending on timeout
+func (st *RunStats) AddRetry() {
+	st.mu.Lock()
+	st.retries++
+	st.mu.Unlock()
+}
+
+//
+// PrintSummary - print the counters if enabled by command line option
+func (st *RunStats) PrintSummary() {
+	if !cliops.wssummary {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	PrintMsg("\n")
+	PrintMsg("Summary:\n"+
+		"    sent: %d messages (%d bytes)\n"+
+		"    received: %d messages (%d bytes)\n"+
+		"    auth challenges: %d\n"+
+		"    retries: %d\n"+
+		"    wall time: %v\n",
+		st.msent, st.bsent, st.mrecv, st.brecv, st.authchl, st.retries, time.Since(st.start))
+}
+
+//
+// Transcript - file with all sent and received messages, written with
+// --transcript
+type Transcript struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+var transcript Transcript
+
+// trace of the messages in ngrep text format, written with --pcap
+var trace Transcript
+
+//
+// Open - open the transcript file for appending
+func (tr *Transcript) Open(fpath string) error {
+	f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	tr.f = f
+	return nil
+}
+
+//
+// Write - append a record with the direction marker, the time and the size,
+// followed by the raw data - nothing done if the file is not open
+func (tr *Transcript) Write(marker string, data []byte) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.f == nil {
+		return
+	}
+	// not buffered, a partial transcript is left in case of crash
+	fmt.Fprintf(tr.f, "%s %s (%d bytes)\n", marker, time.Now().Format(time.RFC3339Nano), len(data))
+	tr.f.Write(data)
+	tr.f.Write([]byte("\n"))
+}
+
+//
+// WriteTrace - append a record in ngrep text format: 'T', the time, the
+// source and destination addresses, followed by the raw data and an empty
+// line - nothing done if the file is not open
+func (tr *Transcript) WriteTrace(src net.Addr, dst net.Addr, data []byte) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.f == nil {
+		return
+	}
+	fmt.Fprintf(tr.f, "T %s %s -> %s\n", time.Now().Format("2006/01/02 15:04:05.000000"), src, dst)
+	tr.f.Write(data)
+	tr.f.Write([]byte("\n\n"))
+}
+
 var templateFields = map[string]map[string]interface{}{
 	"FIELDS:EMPTY": {},
 }
 
+//
+// StringListFlag - command line option that can be provided many times
+type StringListFlag []string
+
+//
+// String - return the values of the option
+func (l *StringListFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+//
+// Set - add a value to the option
+func (l *StringListFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
 //
 // CLIOptions - structure for command line options
 type CLIOptions struct {
@@ -52,6 +352,108 @@ type CLIOptions struct {
 	wsapasswd     string
 	wstimeoutrecv int
 	wstimeoutsend int
+	wstimestamps  bool
+	wsversion     int
+	wsretrytmout  int
+	wsprintreq    bool
+	wsnoautoauth  bool
+	wsfragment    int
+	wsfixcontact  bool
+	wsredirect    bool
+	wsstrictproto bool
+	wslisten      bool
+	wsmaxrecv     int
+	wsoutputdir   string
+	wstlsminver   string
+	wstlsciphers  string
+	wsshownat     bool
+	wsdata        string
+	wsstricttpl   bool
+	wssipdomain   string
+	wssipdomruri  bool
+	wshealthcheck bool
+	wsurls        StringListFlag
+	wscolor       string
+	wsapasswdfile string
+	wssipmethod   string
+	wsscenario    string
+	wsinteractive bool
+	wssummary     bool
+	wsproxy       string
+	wsproxyauth   string
+	wsreplay      string
+	wstranscript  string
+	wsconfig      string
+	wsprofile     string
+	wsmeasurehs   bool
+	wsexpmatch    string
+	wsexpnomatch  string
+	wsauto200     bool
+	wsauto200mth  string
+	wshex         bool
+	wsconnectonly bool
+	wstlscache    bool
+	wsloglevel    string
+	wslogformat   string
+	wstlspins     StringListFlag
+	wsbodyfile    string
+	wsduration    time.Duration
+	wsprotocase   bool
+	wsreqfields   bool
+	wsreconnect   bool
+	wsonrecv      string
+	wsonrecvfail  bool
+	wsexpclose    bool
+	wsvalidate    bool
+	wsvalidonly   bool
+	wsmaxfwd      int
+	wsdeadline    time.Duration
+	wsexplaintpl  bool
+	wsregrefresh  bool
+	wsrefreshrat  float64
+	wsclosecode   int
+	wsclosereason string
+	wsmsgsfile    string
+	wsraw         bool
+	wslf          bool
+	wsshowconn    bool
+	wstpldelims   string
+	wsexpect      StringListFlag
+	wsprintconfig bool
+	wsunixsock    string
+	wsframeraw    bool
+	wsascii       bool
+	wsretransmit  bool
+	wssipt1       int
+	wssipt2       int
+	wsbenchcount  int
+	wspcap        string
+	wskeepalive   int
+	wsdrip        bool
+	wsdripsize    int
+	wsdripdelay   time.Duration
+	wsmaxrespsize int
+	wskaoptions   time.Duration
+	wscorrid      string
+	wssipcorrid   bool
+	wsbundle      string
+	wsbundlecase  string
+	wsstatusonly  bool
+	wsrendercmd   string
+	wsexpfile     string
+	wsdiffignore  string
+	wssdpsummary  bool
+	wsmix         string
+	wstlsreneg    string
+	wsfailon      string
+	wsreaddelay   int
+	wsauthprefer  string
+	wsbenchrate   float64
+	wsinflight    int
+	wsframelog    bool
+	wssendping    bool
+	wspingdata    string
+	wsformat      string
 }
 
 var cliops = CLIOptions{
@@ -68,6 +470,175 @@ var cliops = CLIOptions{
 	wsapasswd:     "",
 	wstimeoutrecv: 20000,
 	wstimeoutsend: 10000,
+	wstimestamps:  false,
+	wsversion:     websocket.ProtocolVersionHybi13,
+	wsretrytmout:  0,
+	wsprintreq:    false,
+	wsnoautoauth:  false,
+	wsfragment:    0,
+	wsfixcontact:  false,
+	wsredirect:    false,
+	wsstrictproto: false,
+	wslisten:      false,
+	wsmaxrecv:     0,
+	wsoutputdir:   "",
+	wstlsminver:   "",
+	wstlsciphers:  "",
+	wsshownat:     false,
+	wsdata:        "",
+	wsstricttpl:   false,
+	wssipdomain:   "",
+	wssipdomruri:  false,
+	wshealthcheck: false,
+	wsurls:        nil,
+	wscolor:       "auto",
+	wsapasswdfile: "",
+	wssipmethod:   "",
+	wsscenario:    "",
+	wsinteractive: false,
+	wssummary:     false,
+	wsproxy:       "",
+	wsproxyauth:   "",
+	wsreplay:      "",
+	wstranscript:  "",
+	wsconfig:      "",
+	wsprofile:     "",
+	wsmeasurehs:   false,
+	wsexpmatch:    "",
+	wsexpnomatch:  "",
+	wsauto200:     false,
+	wsauto200mth:  "NOTIFY,OPTIONS",
+	wshex:         false,
+	wsconnectonly: false,
+	wstlscache:    false,
+	wsloglevel:    "info",
+	wslogformat:   "text",
+	wstlspins:     nil,
+	wsbodyfile:    "",
+	wsduration:    0,
+	wsprotocase:   false,
+	wsreqfields:   false,
+	wsreconnect:   false,
+	wsonrecv:      "",
+	wsonrecvfail:  false,
+	wsexpclose:    false,
+	wsvalidate:    false,
+	wsvalidonly:   false,
+	wsmaxfwd:      0,
+	wsdeadline:    0,
+	wsexplaintpl:  false,
+	wsregrefresh:  false,
+	wsrefreshrat:  0.8,
+	wsclosecode:   0,
+	wsclosereason: "",
+	wsmsgsfile:    "",
+	wsraw:         false,
+	wslf:          false,
+	wsshowconn:    false,
+	wstpldelims:   "",
+	wsexpect:      nil,
+	wsprintconfig: false,
+	wsunixsock:    "",
+	wsframeraw:    false,
+	wsascii:       false,
+	wsretransmit:  false,
+	wssipt1:       500,
+	wssipt2:       4000,
+	wsbenchcount:  0,
+	wspcap:        "",
+	wskeepalive:   0,
+	wsdrip:        false,
+	wsdripsize:    1,
+	wsdripdelay:   100 * time.Millisecond,
+	wsmaxrespsize: 1048576,
+	wskaoptions:   0,
+	wscorrid:      "",
+	wssipcorrid:   false,
+	wsbundle:      "",
+	wsbundlecase:  "",
+	wsstatusonly:  false,
+	wsrendercmd:   "",
+	wsexpfile:     "",
+	wsdiffignore:  "",
+	wssdpsummary:  false,
+	wsmix:         "",
+	wstlsreneg:    "",
+	wsfailon:      "",
+	wsreaddelay:   0,
+	wsauthprefer:  "",
+	wsbenchrate:   0,
+	wsinflight:    0,
+	wsframelog:    false,
+	wssendping:    false,
+	wspingdata:    "",
+	wsformat:      "text",
+}
+
+// flag set used to parse the command line - the one of the subcommand if
+// it is given
+var cliFlags = flag.CommandLine
+
+//
+// Subcommand - verb given as first command line argument, with the options
+// relevant for it and the function to set its specific options
+type Subcommand struct {
+	desc    string
+	options []string
+	setup   func(fs *flag.FlagSet)
+}
+
+// options for the connection and the output, for all subcommands
+var subcmdCommonOptions = []string{
+	"url", "u", "origin", "o", "proto", "p", "insecure", "i", "timeout-send", "timeout-recv",
+	"ws-version", "strict-proto", "proto-strict-case", "tls-min-version", "tls-cipher", "tls-pin", "tls-renegotiation",
+	"tls-session-cache", "proxy", "proxy-auth", "unix-socket", "config", "profile", "log-level",
+	"log-format", "color", "ascii", "timestamps", "summary", "transcript", "measure-handshake",
+	"show-conn", "deadline", "print-config", "close-code", "close-reason", "pcap", "tcp-keepalive", "max-response-size",
+	"correlation-id", "status-only", "frame-log", "send-ping", "ping-data", "format",
+	"version",
+}
+
+// options for building the data to be sent and for sip authentication
+var subcmdDataOptions = []string{
+	"template", "t", "data", "fields", "f", "crlf", "lf", "raw", "hex", "template-delims",
+	"strict-template", "require-fields", "explain-template", "sip-domain", "sip-domain-ruri",
+	"sip-method", "max-forwards", "body-file", "frame-raw", "fragment", "sip-fix-contact",
+	"sip-validate", "auser", "apasswd", "apasswd-file", "auth-prefer", "no-auto-auth", "sip-follow-redirect",
+	"print-request", "on-receive", "on-receive-fail", "drip", "drip-size", "drip-delay",
+	"sip-correlation-id", "bundle", "bundle-case", "render-cmd",
+}
+
+var subcommands = map[string]Subcommand{
+	"send": {
+		desc: "send the data and receive the response (same as without subcommand)",
+		options: append(append(append([]string{}, subcmdCommonOptions...), subcmdDataOptions...),
+			"receive", "r", "retry-on-timeout", "sip-retransmit", "sip-t1", "sip-t2", "sip-show-nat", "sdp-summary", "fail-on",
+			"read-delay",
+			"replay", "messages-file", "scenario", "reconnect-per-message", "interactive", "expect",
+			"expect-file", "diff-ignore-headers",
+			"expect-match", "expect-not-match", "expect-close", "validate-only", "sip-register-refresh",
+			"sip-refresh-ratio", "connect-only", "healthcheck"),
+	},
+	"listen": {
+		desc: "keep receiving data from the server, after sending the data if provided",
+		options: append(append(append([]string{}, subcmdCommonOptions...), subcmdDataOptions...),
+			"max-recv", "output-dir", "duration", "sip-auto-200", "sip-auto-200-methods", "sip-keepalive-options",
+			"read-delay"),
+		setup: func(fs *flag.FlagSet) {
+			cliops.wslisten = true
+		},
+	},
+	"bench": {
+		desc: "send the data many times over the connection and print the response time statistics",
+		options: append(append(append([]string{}, subcmdCommonOptions...), subcmdDataOptions...),
+			"retry-on-timeout", "duration"),
+		setup: func(fs *flag.FlagSet) {
+			fs.IntVar(&cliops.wsbenchcount, "count", 10, "number of times to send the data")
+			fs.Float64Var(&cliops.wsbenchrate, "rate", 0, "target rate of sending the messages, not waiting for the responses (messages per second - 0 to send each one after the response to the previous one)")
+			fs.IntVar(&cliops.wsinflight, "max-inflight", 100, "max number of messages sent with the rate and waiting for the response - the sending waits when it is reached")
+			fs.StringVar(&cliops.wsmix, "mix", "", "template files with weights picked randomly for each message (e.g., 'invite.tpl:70,register.tpl:30')")
+		},
+	},
 }
 
 //
@@ -77,12 +648,15 @@ func init() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s (v%s):\n", filepath.Base(os.Args[0]), wsctlVersion)
 		fmt.Fprintf(os.Stderr, "    (each option has short and long version)\n")
+		fmt.Fprintf(os.Stderr, "    (subcommands: send, listen, bench - see '%s <subcommand> -h')\n", filepath.Base(os.Args[0]))
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 	flag.StringVar(&cliops.wsauser, "auser", cliops.wsauser, "username to be used for authentication")
-	flag.StringVar(&cliops.wsapasswd, "apasswd", cliops.wsapasswd, "password to be used for authentication")
+	flag.StringVar(&cliops.wsapasswd, "apasswd", cliops.wsapasswd, "password to be used for authentication (env:VARNAME or file:path to read it from environment or file)")
+	flag.StringVar(&cliops.wsapasswdfile, "apasswd-file", cliops.wsapasswdfile, "path to the file with the password to be used for authentication")
 	flag.BoolVar(&cliops.wscrlf, "crlf", cliops.wscrlf, "replace '\\n' with '\\r\\n' inside the data to be sent (true|false)")
+	flag.BoolVar(&cliops.wslf, "lf", cliops.wslf, "replace '\\r\\n' with '\\n' inside the data to be sent (true|false)")
 	flag.StringVar(&cliops.wsfields, "fields", cliops.wsfields, "path to the json fields file")
 	flag.StringVar(&cliops.wsfields, "f", cliops.wsfields, "path to the json fields file")
 	flag.BoolVar(&cliops.wsinsecure, "insecure", cliops.wsinsecure, "skip tls certificate validation for wss (true|false)")
@@ -95,275 +669,4726 @@ func init() {
 	flag.BoolVar(&cliops.wsreceive, "r", cliops.wsreceive, "wait to receive response from ws server (true|false)")
 	flag.StringVar(&cliops.wstemplate, "template", cliops.wstemplate, "path to template file (mandatory parameter)")
 	flag.StringVar(&cliops.wstemplate, "t", cliops.wstemplate, "path to template file (mandatory parameter)")
-	flag.StringVar(&cliops.wsurl, "url", cliops.wsurl, "websocket url (ws://... or wss://...)")
-	flag.StringVar(&cliops.wsurl, "u", cliops.wsurl, "websocket url (ws://... or wss://...)")
+	flag.Var(&cliops.wsurls, "url", "websocket url (ws://... or wss://...) - can be given many times, tried in order until connected (default \""+cliops.wsurl+"\")")
+	flag.Var(&cliops.wsurls, "u", "websocket url (ws://... or wss://...) - can be given many times, tried in order until connected (default \""+cliops.wsurl+"\")")
 	flag.BoolVar(&cliops.version, "version", cliops.version, "print version")
-	flag.IntVar(&cliops.wstimeoutrecv, "timeout-recv", cliops.wstimeoutrecv, "timeout waiting to receive data (milliseconds)")
+	flag.IntVar(&cliops.wstimeoutrecv, "timeout-recv", cliops.wstimeoutrecv, "timeout waiting to receive data (milliseconds, 0 or negative to wait indefinitely)")
 	flag.IntVar(&cliops.wstimeoutsend, "timeout-send", cliops.wstimeoutsend, "timeout trying to send data (milliseconds)")
+	flag.BoolVar(&cliops.wstimestamps, "timestamps", cliops.wstimestamps, "prefix output lines with a timestamp (true|false)")
+	flag.IntVar(&cliops.wsversion, "ws-version", cliops.wsversion, "websocket protocol version set in the handshake request (framing done as for 13)")
+	flag.IntVar(&cliops.wsretrytmout, "retry-on-timeout", cliops.wsretrytmout, "number of times to resend the data if no response is received before timeout")
+	flag.BoolVar(&cliops.wsprintreq, "print-request", cliops.wsprintreq, "print also the sent data with escaped control characters (true|false)")
+	flag.BoolVar(&cliops.wsnoautoauth, "no-auto-auth", cliops.wsnoautoauth, "do not resend sip requests with authentication on 401/407 responses (true|false)")
+	flag.IntVar(&cliops.wsfragment, "fragment", cliops.wsfragment, "split the data to be sent in this number of websocket frames (for robustness testing)")
+	flag.BoolVar(&cliops.wsfixcontact, "sip-fix-contact", cliops.wsfixcontact, "rewrite the sip contact uri with the local address and transport=ws (true|false)")
+	flag.BoolVar(&cliops.wsredirect, "sip-follow-redirect", cliops.wsredirect, "resend the sip request to the contact uri of 3xx responses (true|false)")
+	flag.BoolVar(&cliops.wsstrictproto, "strict-proto", cliops.wsstrictproto, "fail if the server does not accept the websocket sub-protocol (true|false)")
+	flag.BoolVar(&cliops.wslisten, "listen", cliops.wslisten, "keep receiving data from ws server until the connection is closed (true|false)")
+	flag.IntVar(&cliops.wsmaxrecv, "max-recv", cliops.wsmaxrecv, "stop listening after receiving this number of messages (0 for unlimited)")
+	flag.StringVar(&cliops.wsoutputdir, "output-dir", cliops.wsoutputdir, "directory where to write each message received in listen mode")
+	flag.StringVar(&cliops.wstlsminver, "tls-min-version", cliops.wstlsminver, "minimum tls version for wss (1.0, 1.1, 1.2 or 1.3)")
+	flag.StringVar(&cliops.wstlsciphers, "tls-cipher", cliops.wstlsciphers, "comma separated list of allowed tls cipher suite names for wss")
+	flag.BoolVar(&cliops.wsshownat, "sip-show-nat", cliops.wsshownat, "print received and rport parameters of the top via in sip responses (true|false)")
+	flag.StringVar(&cliops.wsdata, "data", cliops.wsdata, "inline data template to be sent (instead of template file)")
+	flag.BoolVar(&cliops.wsstricttpl, "strict-template", cliops.wsstricttpl, "fail on missing fields and template function errors (true|false)")
+	flag.StringVar(&cliops.wssipdomain, "sip-domain", cliops.wssipdomain, "sip domain - set as field 'sipdomain' for the data template")
+	flag.StringVar(&cliops.wssipmethod, "sip-method", cliops.wssipmethod, "replace the method in the request line and cseq of the sip request")
+	flag.BoolVar(&cliops.wssipdomruri, "sip-domain-ruri", cliops.wssipdomruri, "replace the host in the sip request uri with the sip domain (true|false)")
+	flag.StringVar(&cliops.wscolor, "color", cliops.wscolor, "color sip messages in output (auto|always|never) - auto is for terminal only")
+	flag.StringVar(&cliops.wsscenario, "scenario", cliops.wsscenario, "path to scenario file with the steps to be executed over the connection")
+	flag.BoolVar(&cliops.wsinteractive, "interactive", cliops.wsinteractive, "interactive mode - send lines typed at prompt and print received data (true|false)")
+	flag.BoolVar(&cliops.wssummary, "summary", cliops.wssummary, "print a summary of the execution at the end (true|false)")
+	flag.StringVar(&cliops.wsreplay, "replay", cliops.wsreplay, "path to file with raw data to be sent as it is (no template processing)")
+	flag.StringVar(&cliops.wstranscript, "transcript", cliops.wstranscript, "path to file where to append all sent and received messages")
+	flag.StringVar(&cliops.wsconfig, "config", cliops.wsconfig, "path to the json config file with connection profiles (default \"$HOME/.wsctl.json\")")
+	flag.StringVar(&cliops.wsprofile, "profile", cliops.wsprofile, "name of the connection profile to load from the config file")
+	flag.BoolVar(&cliops.wsmeasurehs, "measure-handshake", cliops.wsmeasurehs, "print the durations of tcp connect, tls handshake and websocket upgrade (true|false)")
+	flag.StringVar(&cliops.wsexpmatch, "expect-match", cliops.wsexpmatch, "regular expression the response must match, exit with 5 if not")
+	flag.StringVar(&cliops.wsexpnomatch, "expect-not-match", cliops.wsexpnomatch, "regular expression the response must not match, exit with 5 if it does")
+	flag.BoolVar(&cliops.wsauto200, "sip-auto-200", cliops.wsauto200, "reply with 200 ok to sip requests received in listen mode (true|false)")
+	flag.StringVar(&cliops.wsauto200mth, "sip-auto-200-methods", cliops.wsauto200mth, "comma separated list of sip request methods to reply with 200 ok in listen mode")
+	flag.BoolVar(&cliops.wshex, "hex", cliops.wshex, "decode the rendered data from hex string to raw bytes before sending (true|false)")
+	flag.BoolVar(&cliops.wsconnectonly, "connect-only", cliops.wsconnectonly, "only open the websocket connection and close it, no data is sent (true|false)")
+	flag.BoolVar(&cliops.wstlscache, "tls-session-cache", cliops.wstlscache, "use a tls session cache and print if each tls handshake resumed a session - resuming needs a second connection in the run (--reconnect-per-message or failover with many --url), the first one being always a miss (true|false)")
+	flag.StringVar(&cliops.wsloglevel, "log-level", cliops.wsloglevel, "minimum level of the printed messages (debug, info, warn or error)")
+	flag.StringVar(&cliops.wslogformat, "log-format", cliops.wslogformat, "format of the printed messages (text or json)")
+	flag.Var(&cliops.wstlspins, "tls-pin", "accept only the server certificate with this sha256 fingerprint (hex) - can be given many times")
+	flag.StringVar(&cliops.wsbodyfile, "body-file", cliops.wsbodyfile, "path to file with the body to be added to the sip message of the template (with content-length)")
+	flag.DurationVar(&cliops.wsduration, "duration", cliops.wsduration, "stop listening or sending in bench when the run lasted this duration (e.g., 30s, 5m - 0 for unlimited)")
+	flag.BoolVar(&cliops.wsprotocase, "proto-strict-case", cliops.wsprotocase, "fail if the server negotiates the websocket sub-protocol with a different case, instead of connecting again with it (true|false)")
+	flag.BoolVar(&cliops.wsreqfields, "require-fields", cliops.wsreqfields, "require the fields file and fail if the template uses a missing field (true|false)")
+	flag.BoolVar(&cliops.wsreconnect, "reconnect-per-message", cliops.wsreconnect, "use a new websocket connection for each message sent by scenario steps (true|false)")
+	flag.StringVar(&cliops.wsonrecv, "on-receive", cliops.wsonrecv, "shell command to be executed after each receive, with the received data to its stdin")
+	flag.BoolVar(&cliops.wsonrecvfail, "on-receive-fail", cliops.wsonrecvfail, "exit with 6 if the on-receive command fails (true|false)")
+	flag.BoolVar(&cliops.wsexpclose, "expect-close", cliops.wsexpclose, "expect the server to close the connection after the sent data, exit with 5 if not (true|false)")
+	flag.BoolVar(&cliops.wsvalidate, "sip-validate", cliops.wsvalidate, "check that the sip message to be sent has a valid start line and the mandatory headers, fail if not (true|false)")
+	flag.BoolVar(&cliops.wsvalidonly, "validate-only", cliops.wsvalidonly, "only check the sip message like '--sip-validate' and exit, nothing is sent (true|false)")
+	flag.IntVar(&cliops.wsmaxfwd, "max-forwards", cliops.wsmaxfwd, "add the Max-Forwards header with this value to sip requests without it (e.g., 70 - 0 to not add)")
+	flag.DurationVar(&cliops.wsdeadline, "deadline", cliops.wsdeadline, "abort the execution with exit code 4 when it lasted this duration, whatever it does (e.g., 30s - 0 for unlimited)")
+	flag.BoolVar(&cliops.wsexplaintpl, "explain-template", cliops.wsexplaintpl, "print the fields referenced by the data template and the provided fields not used by it (true|false)")
+	flag.BoolVar(&cliops.wsregrefresh, "sip-register-refresh", cliops.wsregrefresh, "resend the sip register before the granted expires, until interrupted (true|false)")
+	flag.Float64Var(&cliops.wsrefreshrat, "sip-refresh-ratio", cliops.wsrefreshrat, "fraction of the granted expires after which the sip register is refreshed (0 to 1)")
+	flag.IntVar(&cliops.wsclosecode, "close-code", cliops.wsclosecode, "status code of the websocket close frame sent before exiting (1000-1003, 1007-1014 or 3000-4999 - 0 for the default 1000)")
+	flag.StringVar(&cliops.wsclosereason, "close-reason", cliops.wsclosereason, "reason text of the websocket close frame sent before exiting (max 123 bytes)")
+	flag.StringVar(&cliops.wsmsgsfile, "messages-file", cliops.wsmsgsfile, "path to file with the messages to be sent in sequence - one per line or, if it has form feeds, one per '\\f' separated block")
+	flag.BoolVar(&cliops.wsraw, "raw", cliops.wsraw, "send the data as it is, without template processing (true|false)")
+	flag.BoolVar(&cliops.wsshowconn, "show-conn", cliops.wsshowconn, "print the local and remote addresses of the connection (true|false)")
+	flag.StringVar(&cliops.wstpldelims, "template-delims", cliops.wstpldelims, "left and right delimiters of the template actions, separated by space (e.g., '[[ ]]' - default '{{ }}')")
+	flag.Var(&cliops.wsexpect, "expect", "rule the response must satisfy, exit with 5 if not (e.g., 'status==200', 'header:Contact~=transport=ws', '!header:Warning') - can be given many times")
+	flag.BoolVar(&cliops.wsprintconfig, "print-config", cliops.wsprintconfig, "print the effective options as json (secrets redacted) and exit (true|false)")
+	flag.StringVar(&cliops.wsunixsock, "unix-socket", cliops.wsunixsock, "path to the unix domain socket to connect to, instead of the host and port of the url (used for the handshake)")
+	flag.BoolVar(&cliops.wsframeraw, "frame-raw", cliops.wsframeraw, "send the data in binary websocket frames, with the exact bytes (true|false)")
+	flag.BoolVar(&cliops.wsascii, "ascii", cliops.wsascii, "print the data with non-printable and non-ascii bytes escaped as \\xNN, without colors (true|false)")
+	flag.BoolVar(&cliops.wsretransmit, "sip-retransmit", cliops.wsretransmit, "retransmit the sip request like over udp (t1 doubled up to t2) until a response or the receive timeout (true|false)")
+	flag.IntVar(&cliops.wssipt1, "sip-t1", cliops.wssipt1, "initial interval for sip request retransmissions (milliseconds)")
+	flag.IntVar(&cliops.wssipt2, "sip-t2", cliops.wssipt2, "maximum interval for sip request retransmissions (milliseconds)")
+	flag.StringVar(&cliops.wspcap, "pcap", cliops.wspcap, "path to file where to append the sent and received messages in ngrep text format, with addresses")
+	flag.IntVar(&cliops.wskeepalive, "tcp-keepalive", cliops.wskeepalive, "enable tcp keepalive with this period on the connection (milliseconds - 0 to not change it)")
+	flag.BoolVar(&cliops.wsdrip, "drip", cliops.wsdrip, "send the data slowly, in frames of drip-size bytes with drip-delay between them (for negative testing) (true|false)")
+	flag.IntVar(&cliops.wsdripsize, "drip-size", cliops.wsdripsize, "number of bytes in each frame in drip mode")
+	flag.DurationVar(&cliops.wsdripdelay, "drip-delay", cliops.wsdripdelay, "delay between the frames in drip mode (e.g., 100ms, 1s)")
+	flag.IntVar(&cliops.wsmaxrespsize, "max-response-size", cliops.wsmaxrespsize, "maximum size of a received message (bytes), larger ones abort the execution")
+	flag.DurationVar(&cliops.wskaoptions, "sip-keepalive-options", cliops.wskaoptions, "send a sip options request with this interval in listen mode (e.g., 30s - 0 to not send)")
+	flag.StringVar(&cliops.wscorrid, "correlation-id", cliops.wscorrid, "correlation id sent in the X-Correlation-ID handshake header ('auto' to generate an uuid)")
+	flag.BoolVar(&cliops.wssipcorrid, "sip-correlation-id", cliops.wssipcorrid, "add the X-Correlation-ID header to sip requests (id generated if '--correlation-id' is not provided)")
+	flag.StringVar(&cliops.wsbundle, "bundle", cliops.wsbundle, "path to zip archive with the data template (template.tpl) and the fields (fields.json)")
+	flag.StringVar(&cliops.wsbundlecase, "bundle-case", cliops.wsbundlecase, "name of the case (directory inside the archive) to be used from the bundle")
+	flag.BoolVar(&cliops.wsstatusonly, "status-only", cliops.wsstatusonly, "print only the first line (e.g., sip status line) of the received messages (true|false)")
+	flag.StringVar(&cliops.wsrendercmd, "render-cmd", cliops.wsrendercmd, "shell command that gets the fields as json on stdin and writes the data to be sent to stdout (replaces the template)")
+	flag.StringVar(&cliops.wsexpfile, "expect-file", cliops.wsexpfile, "path to file with the expected response, exit with 5 and print the differences if it does not match")
+	flag.StringVar(&cliops.wsdiffignore, "diff-ignore-headers", cliops.wsdiffignore, "comma separated list of headers ignored when comparing with the expect file (e.g., Via,Call-ID,Date)")
+	flag.BoolVar(&cliops.wssdpsummary, "sdp-summary", cliops.wssdpsummary, "print the remote media endpoints and codecs from the sdp of sip 1xx/2xx responses (true|false)")
+	flag.StringVar(&cliops.wstlsreneg, "tls-renegotiation", cliops.wstlsreneg, "accept tls renegotiation requested by the server for wss (never, once or freely)")
+	flag.StringVar(&cliops.wsfailon, "fail-on", cliops.wsfailon, "comma separated list of sip response classes or codes that stop the execution with 5, before auth (e.g., 4xx,5xx,6xx or 486)")
+	flag.IntVar(&cliops.wsreaddelay, "read-delay", cliops.wsreaddelay, "wait time (milliseconds) after sending before starting to read the response (0 to not wait)")
+	flag.StringVar(&cliops.wsauthprefer, "auth-prefer", cliops.wsauthprefer, "comma separated list of digest algorithms in the order of preference when many challenges are offered (e.g., SHA-256,MD5)")
+	flag.BoolVar(&cliops.wsframelog, "frame-log", cliops.wsframelog, "print the opcode, fin bit and length of each websocket frame sent and received (true|false)")
+	flag.BoolVar(&cliops.wssendping, "send-ping", cliops.wssendping, "send a websocket ping frame after connecting and print the round-trip time of the pong (true|false)")
+	flag.StringVar(&cliops.wspingdata, "ping-data", cliops.wspingdata, "payload of the ping frame sent with '--send-ping' (max 125 bytes - random if empty)")
+	flag.StringVar(&cliops.wsformat, "format", cliops.wsformat, "format of the printed received messages (text or sip-json)")
+	flag.StringVar(&cliops.wsproxy, "proxy", cliops.wsproxy, "http proxy (host:port) to tunnel the connection through with CONNECT")
+	flag.StringVar(&cliops.wsproxyauth, "proxy-auth", cliops.wsproxyauth, "credentials for the http proxy as user:pass (env:VARNAME or file:path to read them from environment or file)")
+	flag.BoolVar(&cliops.wshealthcheck, "healthcheck", cliops.wshealthcheck, "check the ws server (for sip with an options request) and exit with 0 if ok, 1 if not (true|false)")
 }
 
 //
 // wsctl application
 func main() {
 
-	flag.Parse()
-
-	fmt.Printf("\n")
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		sc, ok := subcommands[os.Args[1]]
+		if !ok {
+			log.Fatalf("unknown subcommand: %s (must be send, listen or bench)", os.Args[1])
+		}
+		cliFlags = NewSubcommandFlagSet(os.Args[1], sc)
+		cliFlags.Parse(os.Args[2:])
+		if os.Args[1] == "bench" && cliops.wsbenchcount <= 0 {
+			log.Fatalf("invalid count value: %d (must be positive)", cliops.wsbenchcount)
+		}
+		if cliops.wsbenchrate < 0 {
+			log.Fatalf("invalid rate value: %v (must not be negative)", cliops.wsbenchrate)
+		}
+		if os.Args[1] == "bench" && cliops.wsinflight <= 0 {
+			log.Fatalf("invalid max-inflight value: %d (must be positive)", cliops.wsinflight)
+		}
+		if cliops.wsbenchrate > 0 && cliops.wstimeoutrecv <= 0 {
+			// a lost response would keep the bench waiting indefinitely
+			log.Fatalf("invalid timeout-recv value: %d (must be positive with rate)", cliops.wstimeoutrecv)
+		}
+	} else {
+		flag.Parse()
+	}
 
 	if cliops.version {
-		fmt.Printf("%s v%s\n", filepath.Base(os.Args[0]), wsctlVersion)
+		fmt.Printf("\n%s v%s\n", filepath.Base(os.Args[0]), wsctlVersion)
 		os.Exit(1)
 	}
 
-	// options for ws connections
-	urlp, err := url.Parse(cliops.wsurl)
-	if err != nil {
-		log.Fatal(err)
+	if cliops.wsprofile != "" {
+		err := LoadProfile(cliops.wsconfig, cliops.wsprofile)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-	orgp, err := url.Parse(cliops.wsorigin)
-	if err != nil {
-		log.Fatal(err)
+
+	if cliops.wsdeadline > 0 {
+		// safety net, whatever is blocking at that moment - the exit
+		// closes the connection, no close before to avoid read errors
+		time.AfterFunc(cliops.wsdeadline, func() {
+			PrintMsg("Deadline: execution aborted after %v\n", cliops.wsdeadline)
+			stats.PrintSummary()
+			os.Exit(exitCodeTimeout)
+		})
 	}
 
-	tlc := tls.Config{
-		InsecureSkipVerify: false,
+	lvl, ok := logLevels[cliops.wsloglevel]
+	if !ok {
+		log.Fatalf("invalid log level: %s (must be debug, info, warn or error)", cliops.wsloglevel)
 	}
-	if cliops.wsinsecure {
-		tlc.InsecureSkipVerify = true
+	logLevel = lvl
+	switch cliops.wslogformat {
+	case "text":
+	case "json":
+		// errors from log package are json records as well
+		log.SetFlags(0)
+		log.SetOutput(jsonLogWriter{})
+	default:
+		log.Fatalf("invalid log format: %s (must be text or json)", cliops.wslogformat)
 	}
 
-	// buffer to send over ws connction
-	var buf bytes.Buffer
-	var tplstr = ""
-	if len(cliops.wstemplate) > 0 {
-		tpldata, err := ioutil.ReadFile(cliops.wstemplate)
-		if err != nil {
-			log.Fatal(err)
-		}
-		tplstr = string(tpldata)
-	} else {
-		log.Fatal("missing data template file ('-t' or '--template' parameter must be provided)")
+	PrintMsg("\n")
+
+	if cliops.wstimestamps && cliops.wslogformat == "text" {
+		log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 	}
 
-	var tplfields interface{}
-	if len(cliops.wsfields) > 0 {
-		fieldsdata, err := ioutil.ReadFile(cliops.wsfields)
-		if err != nil {
-			log.Fatal(err)
-		}
-		err = json.Unmarshal(fieldsdata, &tplfields)
-		if err != nil {
-			log.Fatal(err)
+	switch cliops.wscolor {
+	case "always":
+		colorOutput = true
+	case "never":
+		colorOutput = false
+	case "auto":
+		// only if stdout is a terminal
+		if fi, err := os.Stdout.Stat(); err == nil && (fi.Mode()&os.ModeCharDevice) != 0 {
+			colorOutput = true
 		}
-	} else {
-		tplfields = templateFields["FIELDS:EMPTY"]
+	default:
+		log.Fatalf("invalid color option value: %s (must be auto, always or never)", cliops.wscolor)
 	}
-
-	var tpl = template.Must(template.New("wsout").Parse(tplstr))
-	tpl.Execute(&buf, tplfields)
-
-	var wmsg []byte
-	if cliops.wscrlf {
-		wmsg = []byte(strings.Replace(buf.String(), "\n", "\r\n", -1))
-	} else {
-		wmsg = buf.Bytes()
+	if cliops.wslogformat == "json" || cliops.wsascii {
+		colorOutput = false
 	}
 
-	// open ws connection
-	// ws, err := websocket.Dial(wsurl, "", wsorigin)
-	ws, err := websocket.DialConfig(&websocket.Config{
-		Location:  urlp,
-		Origin:    orgp,
-		Protocol:  []string{cliops.wsproto},
-		Version:   13,
-		TlsConfig: &tlc,
-		Header:    http.Header{"User-Agent": {"wsctl"}},
-	})
-	if err != nil {
-		log.Fatal(err)
+	if cliops.wstpldelims != "" {
+		delims := strings.Fields(cliops.wstpldelims)
+		if len(delims) != 2 {
+			log.Fatalf("invalid template-delims value: '%s' (must be left and right delimiters separated by space)", cliops.wstpldelims)
+		}
+		tplDelimLeft, tplDelimRight = delims[0], delims[1]
 	}
 
-	// send data to ws server
-	err = ws.SetWriteDeadline(time.Now().Add(time.Duration(cliops.wstimeoutsend) * time.Millisecond))
-	_, err = ws.Write(wmsg)
-	if err != nil {
-		log.Fatal(err)
+	if cliops.wscrlf && cliops.wslf {
+		log.Fatal("only one of '--crlf' and '--lf' can be provided")
 	}
-	fmt.Printf("Sending (%d bytes):\n[[%s]]\n", len(wmsg), wmsg)
 
-	// receive data from ws server
-	if cliops.wsreceive {
-		var rmsg = make([]byte, 8192)
-		err = ws.SetReadDeadline(time.Now().Add(time.Duration(cliops.wstimeoutrecv) * time.Millisecond))
-		n, err := ws.Read(rmsg)
+	if cliops.wsapasswdfile != "" {
+		if cliops.wsapasswd != "" {
+			log.Fatal("only one of '--apasswd' and '--apasswd-file' can be provided")
+		}
+		cliops.wsapasswd = "file:" + cliops.wsapasswdfile
+	}
+	if cliops.wsapasswd != "" {
+		apasswd, err := ResolveSecret(cliops.wsapasswd)
 		if err != nil {
 			log.Fatal(err)
 		}
-		fmt.Printf("Receiving (%d bytes):\n[[%s]]\n", n, rmsg)
-		if n > 24 && cliops.wsproto == "sip" {
-			ManageSIPResponse(ws, wmsg, rmsg)
-		}
+		cliops.wsapasswd = apasswd
 	}
-}
 
-//
-// ParseAuthHeader - parse www/proxy-authenticate header body.
-// Return a map of parameters or nil if the header is not Digest auth header.
-func ParseAuthHeader(hbody []byte) map[string]string {
-	s := strings.SplitN(strings.Trim(string(hbody), " "), " ", 2)
-	if len(s) != 2 || s[0] != "Digest" {
-		return nil
+	if cliops.wsunixsock != "" && cliops.wsproxy != "" {
+		log.Fatal("only one of '--unix-socket' and '--proxy' can be provided")
 	}
 
-	params := map[string]string{}
-	for _, kv := range strings.Split(s[1], ",") {
-		parts := strings.SplitN(kv, "=", 2)
-		if len(parts) != 2 {
-			continue
+	if cliops.wsproxyauth != "" {
+		if cliops.wsproxy == "" {
+			log.Fatal("option '--proxy-auth' requires '--proxy'")
 		}
-		params[strings.Trim(parts[0], "\" ")] = strings.Trim(parts[1], "\" ")
+		proxyauth, err := ResolveSecret(cliops.wsproxyauth)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !strings.Contains(proxyauth, ":") {
+			log.Fatal("invalid proxy-auth value (must be user:pass)")
+		}
+		cliops.wsproxyauth = proxyauth
 	}
-	return params
-}
-
-//
-// BuildAuthResponseHeader - return the body for auth header in response
-func BuildAuthResponseHeader(username string, password string, hparams map[string]string) string {
-	// https://en.wikipedia.org/wiki/Digest_access_authentication
-	// HA1
-	h := md5.New()
-	A1 := fmt.Sprintf("%s:%s:%s", username, hparams["realm"], password)
-	io.WriteString(h, A1)
-	HA1 := fmt.Sprintf("%x", h.Sum(nil))
-
-	// HA2
-	h = md5.New()
-	A2 := fmt.Sprintf("%s:%s", hparams["method"], hparams["uri"])
-	io.WriteString(h, A2)
-	HA2 := fmt.Sprintf("%x", h.Sum(nil))
 
-	AuthHeader := ""
-	if _, ok := hparams["qop"]; !ok {
-		// build digest response
-		response := HMD5(strings.Join([]string{HA1, hparams["nonce"], HA2}, ":"))
-		// build header body
-		AuthHeader = fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=MD5, response="%s"`,
-			username, hparams["realm"], hparams["nonce"], hparams["uri"], response)
-	} else {
-		// build digest response
-		cnonce := RandomKey()
-		response := HMD5(strings.Join([]string{HA1, hparams["nonce"], "00000001", cnonce, hparams["qop"], HA2}, ":"))
-		// build header body
-		AuthHeader = fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", cnonce="%s", nc=00000001, qop=%s, opaque="%s", algorithm=MD5, response="%s"`,
-			username, hparams["realm"], hparams["nonce"], hparams["uri"], cnonce, hparams["qop"], hparams["opaque"], response)
+	if cliops.wsexpmatch != "" {
+		var err error
+		expectMatch, err = regexp.Compile(cliops.wsexpmatch)
+		if err != nil {
+			log.Fatalf("invalid expect-match regular expression: %v", err)
+		}
 	}
-	return AuthHeader
-}
-
-//
-// RandomKey - return random key (used for cnonce)
-func RandomKey() string {
-	key := make([]byte, 12)
-	for b := 0; b < len(key); {
-		n, err := rand.Read(key[b:])
+	if cliops.wsexpnomatch != "" {
+		var err error
+		expectNotMatch, err = regexp.Compile(cliops.wsexpnomatch)
 		if err != nil {
-			panic("failed to get random bytes")
+			log.Fatalf("invalid expect-not-match regular expression: %v", err)
 		}
-		b += n
 	}
-	return base64.StdEncoding.EncodeToString(key)
-}
-
-//
-// HMD5 - return a lower-case hex MD5 digest of the parameter
-func HMD5(data string) string {
-	md5d := md5.New()
-	md5d.Write([]byte(data))
-	return fmt.Sprintf("%x", md5d.Sum(nil))
-}
 
-//
-// ManageSIPResponse - process a SIP response
-// - if was a 401/407, follow up with authentication request
-func ManageSIPResponse(ws *websocket.Conn, wmsg []byte, rmsg []byte) bool {
-	if cliops.wsapasswd == "" {
-		return false
+	if cliops.wsclosecode != 0 || cliops.wsclosereason != "" {
+		if cliops.wsclosecode == 0 {
+			cliops.wsclosecode = 1000
+		}
+		c := cliops.wsclosecode
+		if c < 1000 || (c > 1003 && c < 1007) || (c > 1014 && c < 3000) || c > 4999 {
+			log.Fatalf("invalid close-code value: %d (must be 1000-1003, 1007-1014 or 3000-4999)", c)
+		}
+		if len(cliops.wsclosereason) > 123 {
+			log.Fatalf("invalid close-reason value: too long (%d bytes, max 123)", len(cliops.wsclosereason))
+		}
 	}
-	// www or proxy authentication
-	hname := ""
-	if bytes.HasPrefix(rmsg, []byte("SIP/2.0 401 ")) {
-		hname = "WWW-Authenticate:"
-	} else if bytes.HasPrefix(rmsg, []byte("SIP/2.0 407 ")) {
-		hname = "Proxy-Authenticate:"
+
+	for _, c := range strings.Split(cliops.wsfailon, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if c == "" {
+			continue
+		}
+		if len(c) != 3 || c[0] < '1' || c[0] > '6' || !((c[1:] == "xx") || (c[1] >= '0' && c[1] <= '9' && c[2] >= '0' && c[2] <= '9')) {
+			log.Fatalf("invalid fail-on value: %s (must be a response class like 4xx or a status code like 486)", c)
+		}
+		failOnCodes = append(failOnCodes, c)
 	}
-	n := bytes.Index(rmsg, []byte(hname))
-	if n < 0 {
-		return false
+	if cliops.wsauthprefer != "" {
+		authPreference = nil
+		for _, a := range strings.Split(cliops.wsauthprefer, ",") {
+			a = strings.ToUpper(strings.TrimSpace(a))
+			if a == "" {
+				continue
+			}
+			if _, ok := digestHashes[strings.TrimSuffix(a, "-SESS")]; !ok {
+				log.Fatalf("unknown digest algorithm in auth-prefer: %s", a)
+			}
+			authPreference = append(authPreference, a)
+		}
 	}
-	hbody := bytes.Trim(rmsg[n:n+bytes.Index(rmsg[n:], []byte("\n"))], " \t\r")
-	hparams := ParseAuthHeader(hbody[len(hname):])
-	if hparams == nil {
-		return false
+	if cliops.wsexpfile != "" {
+		var err error
+		expectFile, err = ioutil.ReadFile(cliops.wsexpfile)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-	auser := "test"
-	if cliops.wsauser != "" {
-		auser = cliops.wsauser
+	for _, h := range strings.Split(cliops.wsdiffignore, ",") {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if h == "" {
+			continue
+		}
+		diffIgnoreHeaders[h] = true
+		for k, v := range sipCompactHeaders {
+			if strings.EqualFold(v, h) || k == h {
+				diffIgnoreHeaders[k] = true
+				diffIgnoreHeaders[strings.ToLower(v)] = true
+			}
+		}
 	}
 
-	s := strings.SplitN(string(wmsg), " ", 3)
-	if len(s) != 3 {
-		return false
+	for _, r := range cliops.wsexpect {
+		rule, err := ParseExpectRule(r)
+		if err != nil {
+			log.Fatal(err)
+		}
+		expectRules = append(expectRules, rule)
 	}
 
-	hparams["method"] = s[0]
-	hparams["uri"] = s[1]
-	fmt.Printf("\nAuth params map:\n    %+v\n\n", hparams)
-	authResponse := BuildAuthResponseHeader(auser, cliops.wsapasswd, hparams)
-
-	// build new request - increase CSeq and insert auth header
-	n = bytes.Index(wmsg, []byte("CSeq:"))
-	if n < 0 {
-		n = bytes.Index(wmsg, []byte("s:"))
-		if n < 0 {
-			return false
-		}
+	if len(cliops.wsurls) == 0 {
+		cliops.wsurls = StringListFlag{cliops.wsurl}
 	}
-	hbody = bytes.Trim(wmsg[n:n+bytes.Index(wmsg[n:], []byte("\n"))], " \t\r")
-	var obuf bytes.Buffer
-	obuf.Write(wmsg[:n])
-	s = strings.SplitN(string(hbody), " ", 3)
-	if len(s) != 3 {
-		return false
+	cliops.wsurl = cliops.wsurls[0]
+
+	if cliops.wsprintconfig {
+		PrintConfig()
+		return
 	}
-	csn, _ := strconv.Atoi(s[1])
-	cs := strconv.Itoa(1 + csn)
 
-	obuf.WriteString("CSeq: " + cs + " " + s[2] + "\r\n")
-	if hname[0] == 'W' {
-		obuf.WriteString("Authorization: ")
-	} else {
-		obuf.WriteString("Proxy-Authorization: ")
+	if cliops.wsversion != websocket.ProtocolVersionHybi13 {
+		PrintMsg("Websocket version %d set in the handshake request (the frames are still done as for version %d)\n",
+			cliops.wsversion, websocket.ProtocolVersionHybi13)
 	}
-	obuf.WriteString(authResponse)
-	obuf.WriteString("\r\n")
-	obuf.Write(wmsg[1+n+bytes.Index(wmsg[n:], []byte("\n")):])
+
+	tlc := tls.Config{
+		InsecureSkipVerify: false,
+	}
+	if cliops.wsinsecure {
+		tlc.InsecureSkipVerify = true
+	}
+	if cliops.wstlsminver != "" {
+		tlsver, ok := tlsVersions[cliops.wstlsminver]
+		if !ok {
+			log.Fatalf("unknown tls version: %s", cliops.wstlsminver)
+		}
+		tlc.MinVersion = tlsver
+	}
+	if cliops.wstlsciphers != "" {
+		tlsciphers, err := ParseTLSCiphers(cliops.wstlsciphers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlc.CipherSuites = tlsciphers
+	}
+	if cliops.wstlsreneg != "" {
+		treneg, ok := tlsRenegotiations[cliops.wstlsreneg]
+		if !ok {
+			log.Fatalf("unknown tls renegotiation mode: %s (must be never, once or freely)", cliops.wstlsreneg)
+		}
+		tlc.Renegotiation = treneg
+		PrintMsg("TLS renegotiation: %s\n", cliops.wstlsreneg)
+	}
+	if len(cliops.wstlspins) > 0 {
+		// the fingerprint check replaces the verification of the chain
+		tlc.InsecureSkipVerify = true
+		tlc.VerifyPeerCertificate = TLSPinVerifier(cliops.wstlspins)
+	}
+	if cliops.wstlscache {
+		tlc.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+
+	var tplstr = ""
+	if len(cliops.wstemplate) > 0 && len(cliops.wsdata) > 0 {
+		log.Fatal("only one of template file ('-t' or '--template') and inline data ('--data') can be provided")
+	}
+	if len(cliops.wsreplay) > 0 && (len(cliops.wstemplate) > 0 || len(cliops.wsdata) > 0 || len(cliops.wsscenario) > 0) {
+		log.Fatal("the replay file ('--replay') cannot be used with a data template ('--template' or '--data') or a scenario ('--scenario')")
+	}
+	if len(cliops.wsmsgsfile) > 0 && (len(cliops.wstemplate) > 0 || len(cliops.wsdata) > 0 || len(cliops.wsreplay) > 0 || len(cliops.wsscenario) > 0) {
+		log.Fatal("the messages file ('--messages-file') cannot be used with a data template ('--template' or '--data'), a replay file ('--replay') or a scenario ('--scenario')")
+	}
+	if len(cliops.wsbundle) > 0 && (len(cliops.wstemplate) > 0 || len(cliops.wsdata) > 0 || len(cliops.wsreplay) > 0 || len(cliops.wsmsgsfile) > 0 || len(cliops.wsscenario) > 0) {
+		log.Fatal("the bundle file ('--bundle') cannot be used with a data template ('--template' or '--data'), a replay file ('--replay'), a messages file ('--messages-file') or a scenario ('--scenario')")
+	}
+	if len(cliops.wsbundlecase) > 0 && len(cliops.wsbundle) == 0 {
+		log.Fatal("the option '--bundle-case' requires a bundle file ('--bundle')")
+	}
+	if len(cliops.wsrendercmd) > 0 && (len(cliops.wstemplate) > 0 || len(cliops.wsdata) > 0 || len(cliops.wsreplay) > 0 || len(cliops.wsmsgsfile) > 0 || len(cliops.wsscenario) > 0 || len(cliops.wsbundle) > 0) {
+		log.Fatal("the render command ('--render-cmd') cannot be used with a data template ('--template', '--data' or '--bundle'), a replay file ('--replay'), a messages file ('--messages-file') or a scenario ('--scenario')")
+	}
+	if len(cliops.wsrendercmd) > 0 && (cliops.wsraw || cliops.wsinteractive) {
+		log.Fatal("the render command ('--render-cmd') cannot be used with '--raw' or '--interactive'")
+	}
+	var mixtpls []MixTemplate
+	if len(cliops.wsmix) > 0 {
+		if len(cliops.wstemplate) > 0 || len(cliops.wsdata) > 0 || len(cliops.wsbundle) > 0 || len(cliops.wsrendercmd) > 0 {
+			log.Fatal("the template mix ('--mix') cannot be used with a data template ('--template', '--data' or '--bundle') or a render command ('--render-cmd')")
+		}
+		var err error
+		mixtpls, err = ParseMix(cliops.wsmix)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var bfname string
+	var bfdata []byte
+	if len(cliops.wstemplate) > 0 {
+		tpldata, err := ioutil.ReadFile(cliops.wstemplate)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tplstr = string(tpldata)
+	} else if len(cliops.wsbundle) > 0 {
+		var tpldata []byte
+		var err error
+		tpldata, bfname, bfdata, err = ReadBundle(cliops.wsbundle, cliops.wsbundlecase)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tplstr = string(tpldata)
+	} else if len(cliops.wsdata) > 0 {
+		tplstr = cliops.wsdata
+	} else if cliops.wshealthcheck {
+		// internal options template for sip, nothing to send otherwise
+		if cliops.wsproto == "sip" {
+			if cliops.wssipdomain == "" {
+				if u, err := url.Parse(cliops.wsurl); err == nil {
+					cliops.wssipdomain = u.Hostname()
+				}
+			}
+			// set the domain directly, the template delimiters can be changed
+			tplstr = HealthcheckMessage(cliops.wssipdomain)
+		}
+	} else if cliops.wsscenario == "" && cliops.wsreplay == "" && cliops.wsmsgsfile == "" && cliops.wsrendercmd == "" && cliops.wsmix == "" && !cliops.wsinteractive && !cliops.wsconnectonly && !cliops.wslisten {
+		if !cliops.wssendping {
+			log.Fatal("missing data template file ('-t' or '--template' parameter must be provided) or inline data ('--data' parameter)")
+		}
+		// only the ping is sent
+		cliops.wsconnectonly = true
+	}
+
+	var steps []ScenarioStep
+	if cliops.wsscenario != "" {
+		if len(tplstr) > 0 {
+			log.Fatal("the scenario file ('--scenario') cannot be used with a data template ('--template' or '--data')")
+		}
+		sdata, err := ioutil.ReadFile(cliops.wsscenario)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = json.Unmarshal(sdata, &steps)
+		if err != nil {
+			log.Fatalf("failed to parse scenario file %s: %v", cliops.wsscenario, err)
+		}
+	} else if cliops.wsreconnect {
+		log.Fatal("the option '--reconnect-per-message' requires a scenario file ('--scenario')")
+	}
+	if cliops.wsregrefresh && (cliops.wsproto != "sip" || !cliops.wsreceive || cliops.wsscenario != "" || cliops.wsinteractive || cliops.wsexpclose) {
+		log.Fatal("the option '--sip-register-refresh' requires the sip protocol, receiving the response and a data template with a register request")
+	}
+	if cliops.wskaoptions > 0 && (!cliops.wslisten || cliops.wsproto != "sip") {
+		log.Fatal("the option '--sip-keepalive-options' requires the listen mode and the sip protocol")
+	}
+	if cliops.wsformat != "text" && cliops.wsformat != "sip-json" {
+		log.Fatalf("invalid format value: %s (must be text or sip-json)", cliops.wsformat)
+	}
+	if len(cliops.wspingdata) > 125 {
+		log.Fatalf("invalid ping-data value: too long (%d bytes, max 125)", len(cliops.wspingdata))
+	}
+	if cliops.wsmaxrespsize <= 0 {
+		log.Fatalf("invalid max-response-size value: %d (must be positive)", cliops.wsmaxrespsize)
+	}
+	if cliops.wsdrip && cliops.wsdripsize <= 0 {
+		log.Fatalf("invalid drip-size value: %d (must be positive)", cliops.wsdripsize)
+	}
+	if cliops.wsdrip && cliops.wsfragment > 1 {
+		log.Fatal("only one of '--drip' and '--fragment' can be provided")
+	}
+	if cliops.wsretransmit && (cliops.wssipt1 <= 0 || cliops.wssipt2 < cliops.wssipt1) {
+		log.Fatalf("invalid sip retransmission timers: t1=%d t2=%d (t1 must be positive and not greater than t2)", cliops.wssipt1, cliops.wssipt2)
+	}
+	if cliops.wsrefreshrat <= 0 || cliops.wsrefreshrat >= 1 {
+		log.Fatalf("invalid sip-refresh-ratio value: %v (must be between 0 and 1)", cliops.wsrefreshrat)
+	}
+	if cliops.wsvalidonly && (cliops.wsscenario != "" || cliops.wsinteractive || cliops.wsconnectonly || (len(tplstr) == 0 && cliops.wsreplay == "" && cliops.wsmsgsfile == "" && cliops.wsrendercmd == "")) {
+		log.Fatal("the option '--validate-only' requires a data template ('--template' or '--data'), a render command ('--render-cmd'), a replay file ('--replay') or a messages file ('--messages-file')")
+	}
+
+	correlationID = cliops.wscorrid
+	if correlationID == "auto" || (correlationID == "" && cliops.wssipcorrid) {
+		correlationID = NewUUID()
+	}
+	if correlationID != "" {
+		PrintMsg("Correlation ID: %s\n", correlationID)
+	}
+
+	var tplfields interface{}
+	if cliops.wsreqfields && len(cliops.wsfields) == 0 && bfdata == nil {
+		log.Fatal("missing fields file ('-f' or '--fields' parameter must be provided with '--require-fields')")
+	}
+	if len(cliops.wsfields) > 0 {
+		fieldsdata, err := ReadFieldsData(cliops.wsfields)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tplfields, err = ParseFieldsData(cliops.wsfields, fieldsdata)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if bfdata != nil {
+		// fields file option takes precedence over the one in the bundle
+		var err error
+		tplfields, err = ParseFieldsData(bfname, bfdata)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		tplfields = templateFields["FIELDS:EMPTY"]
+	}
+	if cliops.wssipdomain != "" {
+		var err error
+		tplfields, err = SetTemplateField(tplfields, "sipdomain", cliops.wssipdomain)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// options for ws connections - can be templates with the fields data
+	var urlps []*url.URL
+	for _, u := range cliops.wsurls {
+		wsurl, err := RenderOption("url", u, tplfields)
+		if err != nil {
+			log.Fatal(err)
+		}
+		urlp, err := url.Parse(wsurl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		urlps = append(urlps, urlp)
+	}
+	wsorigin, err := RenderOption("origin", cliops.wsorigin, tplfields)
+	if err != nil {
+		log.Fatal(err)
+	}
+	orgp, err := url.Parse(wsorigin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// auth username can be taken from fields, like the one in From header
+	cliops.wsauser, err = RenderOption("auser", cliops.wsauser, tplfields)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tfuncs := NewTemplateFuncs()
+	var wmsg []byte
+	var msgs [][]byte
+	if cliops.wsmsgsfile != "" {
+		mdata, err := ioutil.ReadFile(cliops.wsmsgsfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, mtpl := range SplitMessages(string(mdata)) {
+			m, err := BuildMessage(mtpl, filepath.Dir(cliops.wsmsgsfile), tplfields, tfuncs)
+			if err != nil {
+				log.Fatal(err)
+			}
+			msgs = append(msgs, m)
+		}
+		if len(msgs) == 0 {
+			log.Fatalf("no messages in file %s", cliops.wsmsgsfile)
+		}
+	} else if cliops.wsreplay != "" {
+		// raw data sent as it is, only line endings updated if asked
+		wmsg, err = ioutil.ReadFile(cliops.wsreplay)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if cliops.wscrlf {
+			wmsg = ToCRLF(wmsg)
+		} else if cliops.wslf {
+			wmsg = ToLF(wmsg)
+		}
+		PrintMsg("Replaying file %s (%d bytes)\n", cliops.wsreplay, len(wmsg))
+	} else if cliops.wsscenario == "" && !cliops.wsconnectonly {
+		tpldir := "."
+		if len(cliops.wstemplate) > 0 {
+			tpldir = filepath.Dir(cliops.wstemplate)
+		} else if len(cliops.wsbundle) > 0 {
+			tpldir = filepath.Dir(cliops.wsbundle)
+		}
+		wmsg, err = BuildMessage(tplstr, tpldir, tplfields, tfuncs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if cliops.wsbodyfile != "" {
+			body, err := ioutil.ReadFile(cliops.wsbodyfile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if cliops.wscrlf {
+				body = ToCRLF(body)
+			} else if cliops.wslf {
+				body = ToLF(body)
+			}
+			wmsg, err = SIPAttachBody(wmsg, body)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	if cliops.wsvalidate || cliops.wsvalidonly {
+		if msgs != nil {
+			for _, m := range msgs {
+				ValidateSIPMessage(m)
+			}
+		} else {
+			ValidateSIPMessage(wmsg)
+		}
+	}
+	if cliops.wsvalidonly {
+		return
+	}
+
+	if cliops.wstranscript != "" {
+		err = transcript.Open(cliops.wstranscript)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cliops.wspcap != "" {
+		err = trace.Open(cliops.wspcap)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if cliops.wsoutputdir != "" {
+		err = os.MkdirAll(cliops.wsoutputdir, 0755)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// open ws connection
+	// ws, err := websocket.Dial(wsurl, "", wsorigin)
+	wscfg := &websocket.Config{
+		Origin:   orgp,
+		Protocol: WSProtocols(cliops.wsproto),
+		// the websocket library accepts only version 13, other values are
+		// set in the handshake request by the connection wrapper
+		Version:   websocket.ProtocolVersionHybi13,
+		TlsConfig: &tlc,
+		Header:    http.Header{"User-Agent": {"wsctl"}},
+	}
+	if correlationID != "" {
+		// exact case of the name kept for matching in server logs
+		wscfg.Header["X-Correlation-ID"] = []string{correlationID}
+	}
+	tconnect := time.Now()
+	ws, err := DialURLs(urlps, wscfg)
+	if err != nil {
+		if cliops.wsconnectonly {
+			PrintMsg("Connect: FAILED after %v (%v)\n", time.Since(tconnect), err)
+			os.Exit(1)
+		}
+		log.Fatal(err)
+	}
+	dconnect := time.Since(tconnect)
+
+	// check the negotiated sub-protocol
+	if cliops.wsproto != "" {
+		nproto := wsresponse.Header.Get("Sec-WebSocket-Protocol")
+		if nproto != cliops.wsproto && (cliops.wsprotocase || !strings.EqualFold(nproto, cliops.wsproto)) {
+			if cliops.wsstrictproto {
+				log.Fatalf("websocket sub-protocol not accepted - requested '%s', negotiated '%s'", cliops.wsproto, nproto)
+			}
+			PrintWarn("websocket sub-protocol not accepted - requested '%s', negotiated '%s'\n", cliops.wsproto, nproto)
+		}
+	}
+
+	if cliops.wssendping {
+		SendPing(ws)
+	}
+
+	if cliops.wsconnectonly {
+		CloseConn(ws)
+		PrintMsg("Connect: OK in %v\n", dconnect)
+		stats.PrintSummary()
+		return
+	}
+
+	if cliops.wsproto == "sip" && cliops.wsfixcontact {
+		wmsg = SIPFixContact(wmsg, wsconn.LocalAddr())
+	}
+
+	if cliops.wshealthcheck {
+		ret := HealthCheck(ws, wmsg)
+		stats.PrintSummary()
+		os.Exit(ret)
+	}
+
+	if cliops.wsscenario != "" {
+		var redial func() (*websocket.Conn, error)
+		if cliops.wsreconnect {
+			redial = func() (*websocket.Conn, error) {
+				return DialURLs(urlps, wscfg)
+			}
+		}
+		ws = RunScenario(ws, redial, steps, filepath.Dir(cliops.wsscenario), tplfields, tfuncs)
+	} else if cliops.wsbenchcount > 0 {
+		RunBench(ws, wmsg, mixtpls, tplfields, tfuncs)
+	} else if msgs != nil {
+		for i, m := range msgs {
+			PrintMsg("Message %d of %d\n", i+1, len(msgs))
+			if cliops.wsproto == "sip" && cliops.wsfixcontact {
+				m = SIPFixContact(m, wsconn.LocalAddr())
+			}
+			rmsg := SendRecvData(ws, m)
+			if expectMatch != nil || expectNotMatch != nil || len(expectRules) > 0 || expectFile != nil {
+				CheckExpect(rmsg)
+			}
+		}
+	} else if cliops.wsexpclose {
+		ExpectClose(ws, wmsg)
+	} else if (!cliops.wsinteractive && !cliops.wslisten) || len(wmsg) > 0 {
+		rmsg := SendRecvData(ws, wmsg)
+		if expectMatch != nil || expectNotMatch != nil || len(expectRules) > 0 || expectFile != nil {
+			CheckExpect(rmsg)
+		}
+		if cliops.wsregrefresh {
+			RegisterRefresh(ws, wmsg, rmsg)
+		}
+	}
+
+	if cliops.wsinteractive {
+		RunInteractive(ws, tplfields, tfuncs)
+		stats.PrintSummary()
+		return
+	}
+
+	// keep receiving data from ws server
+	if cliops.wslisten {
+		ListenData(ws)
+	}
+	CloseConn(ws)
+	stats.PrintSummary()
+}
+
+//
+// NewSubcommandFlagSet - return the flag set with the options of the
+// subcommand - they share the values with the global options
+func NewSubcommandFlagSet(name string, sc Subcommand) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s %s (v%s) - %s:\n", filepath.Base(os.Args[0]), name, wsctlVersion, sc.desc)
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	for _, oname := range sc.options {
+		f := flag.Lookup(oname)
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+	if sc.setup != nil {
+		sc.setup(fs)
+	}
+	return fs
+}
+
+//
+// RunBench - send the data the number of times set by the bench count over
+// the connection and print the statistics of the response times - for sip,
+// each request is a new transaction; if mix is not empty, the data is built
+// for each message from a template picked randomly by weight; if the rate is
+// set, the sending is done by RunBenchRate, otherwise each message is sent
+// after the response to the previous one; it stops when the duration is
+// reached, if set
+func RunBench(ws *websocket.Conn, wmsg []byte, mix []MixTemplate, tplfields interface{}, tfuncs template.FuncMap) {
+	if cliops.wsbenchrate > 0 {
+		RunBenchRate(ws, wmsg, mix, tplfields, tfuncs)
+		return
+	}
+	var times BenchTimes
+	nsent := 0
+	tstart := time.Now()
+	for i := 0; i < cliops.wsbenchcount; i++ {
+		if cliops.wsduration > 0 && time.Since(tstart) >= cliops.wsduration {
+			PrintMsg("Duration of %v reached\n", cliops.wsduration)
+			break
+		}
+		wmsg = BenchMessage(i, wmsg, mix, tplfields, tfuncs)
+		tsend := time.Now()
+		SendRecvData(ws, wmsg)
+		times.Add(time.Since(tsend))
+		nsent++
+	}
+	if nsent == 0 {
+		PrintMsg("Bench: no message sent\n")
+		return
+	}
+	drun := time.Since(tstart)
+	PrintMsg("Bench: %d messages in %v (%.1f msg/s) - response time %s\n",
+		nsent, drun, float64(nsent)/drun.Seconds(), times.String())
+	PrintBenchMix(mix, nsent)
+}
+
+//
+// RunBenchRate - send the bench messages at each tick of the rate, without
+// waiting for the responses (open model) - they are received by a separate
+// goroutine, matched to the sent messages, and the sending waits only when
+// the number of messages without response reaches the max in-flight limit;
+// the responses are not processed further (e.g., no authentication)
+func RunBenchRate(ws *websocket.Conn, wmsg []byte, mix []MixTemplate, tplfields interface{}, tfuncs template.FuncMap) {
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / cliops.wsbenchrate))
+	defer ticker.Stop()
+	// a slot is taken for each message in flight
+	slots := make(chan struct{}, cliops.wsinflight)
+	sentc := make(chan benchPending, cliops.wsinflight)
+	var times BenchTimes
+	nlost := 0
+	done := make(chan struct{})
+	if cliops.wsreceive {
+		go func() {
+			times, nlost = BenchReceive(ws, sentc, slots)
+			close(done)
+		}()
+	}
+	nsent, nwait, maxinflight := 0, 0, 0
+	var tstart, tlast time.Time
+	for i := 0; i < cliops.wsbenchcount; i++ {
+		if i > 0 {
+			// the ticks missed while waiting for a slot are dropped
+			<-ticker.C
+		}
+		if i > 0 && cliops.wsduration > 0 && time.Since(tstart) >= cliops.wsduration {
+			PrintMsg("Duration of %v reached\n", cliops.wsduration)
+			break
+		}
+		wmsg = BenchMessage(i, wmsg, mix, tplfields, tfuncs)
+		if cliops.wsreceive {
+			select {
+			case slots <- struct{}{}:
+			default:
+				nwait++
+				PrintMsg("Bench: %d messages in flight - waiting for a response\n", cap(slots))
+				slots <- struct{}{}
+			}
+			if len(slots) > maxinflight {
+				maxinflight = len(slots)
+			}
+			// given to the receiver before sending, to be there for the response
+			p := benchPending{tsend: time.Now()}
+			if cliops.wsproto == "sip" {
+				p.cseq = SIPCSeqNumber(wmsg)
+			}
+			sentc <- p
+		}
+		tlast = time.Now()
+		if i == 0 {
+			tstart = tlast
+		}
+		if err := SendData(ws, wmsg); err != nil {
+			log.Fatal(err)
+		}
+		PrintMsg("Sending (%d bytes):\n[[%s]]\n", len(wmsg), DisplayData(wmsg))
+		PrintRequest(wmsg)
+		nsent++
+	}
+	close(sentc)
+	if cliops.wsreceive {
+		<-done
+	}
+	drun := time.Since(tstart)
+	PrintMsg("Bench: %d messages in %v - %d responses, %d without response - response time %s\n",
+		nsent, drun, times.n, nlost, times.String())
+	if nsent > 1 {
+		PrintMsg("Bench rate: target %.1f msg/s, achieved %.1f msg/s\n", cliops.wsbenchrate,
+			float64(nsent-1)/tlast.Sub(tstart).Seconds())
+	}
+	if cliops.wsreceive {
+		PrintMsg("Bench in-flight: max %d of %d, sending waited %d times for a response\n",
+			maxinflight, cap(slots), nwait)
+	}
+	PrintBenchMix(mix, nsent)
+	if nlost > 0 {
+		stats.PrintSummary()
+		os.Exit(exitCodeTimeout)
+	}
+}
+
+//
+// benchPending - bench message sent and waiting for the response, with the
+// CSeq number to match the sip response
+type benchPending struct {
+	cseq  int
+	tsend time.Time
+}
+
+//
+// BenchReceive - receive the responses to the bench messages given on the
+// channel, until it is closed and all of them are answered or timed out -
+// sip responses are matched by CSeq (the provisional ones are skipped), the
+// other data in sending order; a slot is released for each sent message;
+// return the response times and the number of messages without response
+func BenchReceive(ws *websocket.Conn, sentc <-chan benchPending, slots <-chan struct{}) (BenchTimes, int) {
+	var times BenchTimes
+	var pending []benchPending
+	nlost := 0
+	tmout := time.Duration(cliops.wstimeoutrecv) * time.Millisecond
+	for {
+		if len(pending) == 0 {
+			p, ok := <-sentc
+			if !ok {
+				return times, nlost
+			}
+			pending = append(pending, p)
+		}
+		rmsg, err := RecvData(ws)
+		trecv := time.Now()
+		// the messages sent meanwhile
+		for more := true; more; {
+			select {
+			case p, ok := <-sentc:
+				if !ok {
+					more = false
+					break
+				}
+				pending = append(pending, p)
+			default:
+				more = false
+			}
+		}
+		if err != nil {
+			if !os.IsTimeout(err) {
+				FatalRecvError(err)
+			}
+			// the messages sent before the receive timeout are dropped
+			var npending []benchPending
+			for _, p := range pending {
+				if trecv.Sub(p.tsend) < tmout {
+					npending = append(npending, p)
+					continue
+				}
+				nlost++
+				<-slots
+			}
+			PrintMsg("Bench: %d messages without response before the timeout (%dms)\n",
+				len(pending)-len(npending), cliops.wstimeoutrecv)
+			pending = npending
+			continue
+		}
+		PrintRecvData(fmt.Sprintf("Receiving (%d bytes):", len(rmsg)), rmsg)
+		k := 0
+		if cliops.wsproto == "sip" {
+			if !isSIPResponse(rmsg) || SIPStatusCode(rmsg) < 200 {
+				// not a final response
+				continue
+			}
+			cseq := SIPCSeqNumber(rmsg)
+			k = -1
+			for j, p := range pending {
+				if p.cseq == cseq {
+					k = j
+					break
+				}
+			}
+			if k < 0 {
+				PrintWarn("bench response with CSeq %d not matching a sent message - discarded\n", cseq)
+				continue
+			}
+		}
+		times.Add(trecv.Sub(pending[k].tsend))
+		pending = append(pending[:k], pending[k+1:]...)
+		<-slots
+	}
+}
+
+//
+// BenchMessage - return the data of the bench message with index i: built
+// from a template picked from the mix if not empty and, for a sip request
+// after the first one, with the next CSeq number and a new Via branch
+func BenchMessage(i int, wmsg []byte, mix []MixTemplate, tplfields interface{}, tfuncs template.FuncMap) []byte {
+	if len(mix) > 0 {
+		k := PickMixTemplate(mix)
+		var err error
+		wmsg, err = BuildMessage(mix[k].tpl, filepath.Dir(mix[k].path), tplfields, tfuncs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mix[k].sent++
+		PrintMsg("Bench template: %s\n", mix[k].path)
+	}
+	if i > 0 && cliops.wsproto == "sip" && SIPRequestMethod(wmsg) != "" {
+		wmsg = SIPNewViaBranch(SIPSetCSeqNumber(wmsg, SIPCSeqNumber(lastSent)+1))
+	}
+	PrintMsg("Bench message %d of %d\n", i+1, cliops.wsbenchcount)
+	return wmsg
+}
+
+//
+// PrintBenchMix - print how many times each template of the mix was sent
+func PrintBenchMix(mix []MixTemplate, nsent int) {
+	for _, m := range mix {
+		PrintMsg("Bench mix: %s sent %d times (%.1f%%, weight %d)\n", m.path, m.sent,
+			100*float64(m.sent)/float64(nsent), m.weight)
+	}
+}
+
+//
+// BenchTimes - statistics of the bench response times
+type BenchTimes struct {
+	n      int
+	tmin   time.Duration
+	tmax   time.Duration
+	ttotal time.Duration
+}
+
+//
+// Add - account a response time
+func (bt *BenchTimes) Add(d time.Duration) {
+	if bt.n == 0 || d < bt.tmin {
+		bt.tmin = d
+	}
+	if d > bt.tmax {
+		bt.tmax = d
+	}
+	bt.ttotal += d
+	bt.n++
+}
+
+//
+// String - return the min, average and max response times
+func (bt *BenchTimes) String() string {
+	if bt.n == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("min=%v avg=%v max=%v", bt.tmin, bt.ttotal/time.Duration(bt.n), bt.tmax)
+}
+
+//
+// MixTemplate - template file of the bench mix, with its weight and the
+// number of times it was sent
+type MixTemplate struct {
+	path   string
+	weight int
+	tpl    string
+	sent   int
+}
+
+//
+// ParseMix - return the templates of the mix option, a comma separated list
+// of 'path:weight' items, reading the template files
+func ParseMix(spec string) ([]MixTemplate, error) {
+	var mix []MixTemplate
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		c := strings.LastIndex(item, ":")
+		if c <= 0 {
+			return nil, fmt.Errorf("invalid mix item: %s (must be path:weight)", item)
+		}
+		weight, err := strconv.Atoi(item[c+1:])
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("invalid mix weight: %s (must be a positive number)", item)
+		}
+		tpldata, err := ioutil.ReadFile(item[:c])
+		if err != nil {
+			return nil, err
+		}
+		mix = append(mix, MixTemplate{path: item[:c], weight: weight, tpl: string(tpldata)})
+	}
+	if len(mix) == 0 {
+		return nil, fmt.Errorf("empty mix value")
+	}
+	return mix, nil
+}
+
+//
+// PickMixTemplate - return the index of a template of the mix, selected
+// randomly with the probability given by its weight
+func PickMixTemplate(mix []MixTemplate) int {
+	total := 0
+	for _, m := range mix {
+		total += m.weight
+	}
+	r, err := rand.Int(rand.Reader, big.NewInt(int64(total)))
+	if err != nil {
+		panic("failed to get random number")
+	}
+	n := int(r.Int64())
+	for i, m := range mix {
+		if n < m.weight {
+			return i
+		}
+		n -= m.weight
+	}
+	return len(mix) - 1
+}
+
+//
+// ParseTLSCiphers - return the ids of the tls cipher suites from a comma
+// separated list of names (e.g., TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)
+func ParseTLSCiphers(names string) ([]uint16, error) {
+	csmap := map[string]uint16{}
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		csmap[cs.Name] = cs.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := csmap[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls cipher suite: %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+//
+// TLSPinVerifier - return the function to check that the sha256 fingerprint
+// of the server certificate is one of the pins (hex, ':' separators allowed)
+func TLSPinVerifier(pins []string) func([][]byte, [][]*x509.Certificate) error {
+	npins := make(map[string]bool, len(pins))
+	for _, p := range pins {
+		npins[strings.ToLower(strings.Replace(p, ":", "", -1))] = true
+	}
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("no server certificate")
+		}
+		fp := fmt.Sprintf("%x", sha256.Sum256(rawCerts[0]))
+		if !npins[fp] {
+			return fmt.Errorf("server certificate fingerprint not pinned - observed sha256: %s", fp)
+		}
+		PrintDebug("Server certificate fingerprint pinned: %s\n", fp)
+		return nil
+	}
+}
+
+//
+// WSNetConn - wrapper of the network connection, recording the data read
+// until the end of the websocket handshake response headers and parsing
+// passively the headers of the frames received after it (and of the sent
+// frames, for the frame log)
+type WSNetConn struct {
+	net.Conn
+	hsdata []byte
+	hsdone bool
+	// frame being parsed - header, payload length and bytes left, control
+	// payload
+	fhdr  []byte
+	flen  int64
+	fleft int64
+	fctl  []byte
+	// close frame received and its status code (0 if not provided)
+	closeframe bool
+	closecode  int
+	// sent frame being parsed - header and payload bytes left
+	wfhdr  []byte
+	wfleft int64
+	// payload of the sent ping, waiting for the pong with it, and the time
+	// when the pong was received
+	pingdata []byte
+	pingwait bool
+	pongtime time.Time
+}
+
+// names of the websocket frame opcodes
+var wsOpcodeNames = map[byte]string{
+	websocket.ContinuationFrame: "continuation",
+	websocket.TextFrame:         "text",
+	websocket.BinaryFrame:       "binary",
+	websocket.CloseFrame:        "close",
+	websocket.PingFrame:         "ping",
+	websocket.PongFrame:         "pong",
+}
+
+//
+// Read - read from the network connection, recording the handshake data
+func (c *WSNetConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		data := b[:n]
+		if !c.hsdone {
+			c.hsdata = append(c.hsdata, data...)
+			if p := bytes.Index(c.hsdata, []byte("\r\n\r\n")); p >= 0 {
+				// frames can follow in the same read
+				data = c.hsdata[p+4:]
+				c.hsdata = c.hsdata[:p+4]
+				c.hsdone = true
+			} else {
+				data = nil
+			}
+		}
+		c.parseFrames(data)
+	}
+	return n, err
+}
+
+//
+// Write - write to the network connection, following the headers of the
+// sent frames if the frame log is enabled - the version header of the
+// handshake request is replaced if the ws-version option is not 13
+func (c *WSNetConn) Write(b []byte) (int, error) {
+	if !c.hsdone && cliops.wsversion != websocket.ProtocolVersionHybi13 {
+		// handshake request, with the version header written by the
+		// websocket library for version 13
+		hsreq := bytes.Replace(b, []byte("\r\nSec-WebSocket-Version: 13\r\n"),
+			[]byte("\r\nSec-WebSocket-Version: "+strconv.Itoa(cliops.wsversion)+"\r\n"), 1)
+		if _, err := c.Conn.Write(hsreq); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	n, err := c.Conn.Write(b)
+	if cliops.wsframelog && c.hsdone && n > 0 {
+		c.parseSentFrames(b[:n])
+	}
+	return n, err
+}
+
+//
+// parseSentFrames - follow the frame headers in the sent data
+func (c *WSNetConn) parseSentFrames(data []byte) {
+	for len(data) > 0 {
+		if c.wfleft > 0 {
+			n := int64(len(data))
+			if n > c.wfleft {
+				n = c.wfleft
+			}
+			c.wfleft -= n
+			data = data[n:]
+			continue
+		}
+		c.wfhdr = append(c.wfhdr, data[0])
+		data = data[1:]
+		if len(c.wfhdr) < FrameHeaderLen(c.wfhdr) {
+			continue
+		}
+		c.wfleft = FramePayloadLen(c.wfhdr)
+		PrintFrameLog("sent", c.wfhdr, c.wfleft)
+		c.wfhdr = nil
+	}
+}
+
+//
+// parseFrames - follow the frame headers in the received data
+func (c *WSNetConn) parseFrames(data []byte) {
+	for len(data) > 0 {
+		if c.fleft > 0 {
+			n := int64(len(data))
+			if n > c.fleft {
+				n = c.fleft
+			}
+			if c.fhdr[0]&0x08 != 0 {
+				// control frame, small payload kept
+				c.fctl = append(c.fctl, data[:n]...)
+			}
+			c.fleft -= n
+			data = data[n:]
+			if c.fleft == 0 {
+				c.frameDone()
+			}
+			continue
+		}
+		c.fhdr = append(c.fhdr, data[0])
+		data = data[1:]
+		if len(c.fhdr) < FrameHeaderLen(c.fhdr) {
+			continue
+		}
+		c.fleft = FramePayloadLen(c.fhdr)
+		c.flen = c.fleft
+		if cliops.wsframelog {
+			PrintFrameLog("received", c.fhdr, c.flen)
+		}
+		if c.fleft == 0 {
+			c.frameDone()
+		}
+	}
+}
+
+//
+// FrameHeaderLen - return the length of the frame header, based on its first
+// two bytes (the extended payload length and the mask key included) - 2 if
+// they are not available yet
+func FrameHeaderLen(fhdr []byte) int {
+	if len(fhdr) < 2 {
+		return 2
+	}
+	hlen := 2
+	switch fhdr[1] & 0x7f {
+	case 126:
+		hlen += 2
+	case 127:
+		hlen += 8
+	}
+	if fhdr[1]&0x80 != 0 {
+		hlen += 4
+	}
+	return hlen
+}
+
+//
+// FramePayloadLen - return the payload length from the complete frame header
+func FramePayloadLen(fhdr []byte) int64 {
+	var plen int64
+	switch l := int64(fhdr[1] & 0x7f); l {
+	case 126:
+		plen = int64(fhdr[2])<<8 | int64(fhdr[3])
+	case 127:
+		for _, v := range fhdr[2:10] {
+			plen = plen<<8 | int64(v)
+		}
+	default:
+		plen = l
+	}
+	return plen
+}
+
+//
+// PrintFrameLog - print the opcode, the fin bit and the payload length of a
+// sent or received frame, from its header
+func PrintFrameLog(dir string, fhdr []byte, plen int64) {
+	opname, ok := wsOpcodeNames[fhdr[0]&0x0f]
+	if !ok {
+		opname = fmt.Sprintf("reserved(%d)", fhdr[0]&0x0f)
+	}
+	PrintMsg("Frame %s: opcode=%s fin=%d masked=%t length=%d\n", dir, opname, fhdr[0]>>7, fhdr[1]&0x80 != 0, plen)
+}
+
+//
+// frameDone - process the end of a received frame
+func (c *WSNetConn) frameDone() {
+	if c.pingwait && c.fhdr[0]&0x0f == websocket.PongFrame && bytes.Equal(c.fctl, c.pingdata) {
+		// the pong is discarded by the websocket package, its read is
+		// interrupted to report it
+		c.pingwait = false
+		c.pongtime = time.Now()
+		c.Conn.SetReadDeadline(c.pongtime)
+	}
+	if c.fhdr[0]&0x0f == websocket.CloseFrame {
+		c.closeframe = true
+		if len(c.fctl) >= 2 {
+			c.closecode = int(c.fctl[0])<<8 | int(c.fctl[1])
+		}
+	}
+	c.fhdr = nil
+	c.fctl = nil
+}
+
+//
+// WSDial - open the websocket connection, keeping a reference to the
+// underlying network connection in wsconn
+func WSDial(wsc *websocket.Config) (*websocket.Conn, error) {
+	addr := wsc.Location.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		if wsc.Location.Scheme == "wss" {
+			addr = net.JoinHostPort(addr, "443")
+		} else {
+			addr = net.JoinHostPort(addr, "80")
+		}
+	}
+	var conn net.Conn
+	var err error
+	var ttcp, ttls time.Duration
+	tstart := time.Now()
+	switch wsc.Location.Scheme {
+	case "ws":
+		conn, err = DialTCP(addr)
+		ttcp = time.Since(tstart)
+	case "wss":
+		conn, err = DialTCP(addr)
+		ttcp = time.Since(tstart)
+		if err == nil {
+			tlc := &tls.Config{}
+			if wsc.TlsConfig != nil {
+				tlc = wsc.TlsConfig.Clone()
+			}
+			if tlc.ServerName == "" {
+				tlc.ServerName = wsc.Location.Hostname()
+			}
+			tconn := tls.Client(conn, tlc)
+			if err = tconn.Handshake(); err != nil {
+				conn.Close()
+			} else {
+				conn = tconn
+				if tlc.ClientSessionCache != nil {
+					if tconn.ConnectionState().DidResume {
+						PrintMsg("TLS session resumed: yes (hit)\n")
+					} else {
+						PrintMsg("TLS session resumed: no (miss)\n")
+					}
+				}
+			}
+			ttls = time.Since(tstart) - ttcp
+		}
+	default:
+		err = websocket.ErrBadScheme
+	}
+	if err != nil {
+		return nil, &websocket.DialError{Config: wsc, Err: err}
+	}
+	twsstart := time.Now()
+	wconn := &WSNetConn{Conn: conn}
+	ws, err := websocket.NewClient(wsc, wconn)
+	if err != nil {
+		conn.Close()
+		if err == websocket.ErrBadStatus && cliops.wsversion != websocket.ProtocolVersionHybi13 {
+			// response of the server to the non-standard version
+			resp, rerr := http.ReadResponse(bufio.NewReader(bytes.NewReader(wconn.hsdata)), nil)
+			if rerr == nil {
+				PrintMsg("Handshake with websocket version %d rejected: %s (server versions: '%s')\n",
+					cliops.wsversion, resp.Status, resp.Header.Get("Sec-WebSocket-Version"))
+			}
+		}
+		if err == websocket.ErrBadWebSocketProtocol && len(wsc.Protocol) == 1 {
+			// sub-protocol accepted by the server with a different case
+			resp, rerr := http.ReadResponse(bufio.NewReader(bytes.NewReader(wconn.hsdata)), nil)
+			if rerr == nil {
+				oproto := resp.Header.Get("Sec-WebSocket-Protocol")
+				if strings.EqualFold(oproto, wsc.Protocol[0]) {
+					if cliops.wsprotocase {
+						err = fmt.Errorf("websocket sub-protocol case mismatch - requested '%s', negotiated '%s'", wsc.Protocol[0], oproto)
+					} else {
+						PrintWarn("websocket sub-protocol negotiated with different case - requested '%s', negotiated '%s' - connecting again with it\n",
+							wsc.Protocol[0], oproto)
+						pcfg := *wsc
+						pcfg.Protocol = []string{oproto}
+						return WSDial(&pcfg)
+					}
+				}
+			}
+		}
+		return nil, &websocket.DialError{Config: wsc, Err: err}
+	}
+	tws := time.Since(twsstart)
+	wsresponse, err = http.ReadResponse(bufio.NewReader(bytes.NewReader(wconn.hsdata)), nil)
+	if err != nil {
+		conn.Close()
+		return nil, &websocket.DialError{Config: wsc, Err: err}
+	}
+	PrintDebug("Websocket handshake with %s (origin: %s, protocol: %q, version: %d) - response:\n%s",
+		wsc.Location, wsc.Origin, wsc.Protocol, wsc.Version, wconn.hsdata)
+	if cliops.wsmeasurehs {
+		PrintMsg("Handshake timing: tcp=%.3fms tls=%.3fms ws=%.3fms\n",
+			ttcp.Seconds()*1000, ttls.Seconds()*1000, tws.Seconds()*1000)
+	}
+	if cliops.wsshowconn {
+		PrintMsg("Connection: %s\n", ConnTuple(conn, wsc.Location.Scheme))
+	}
+	if cliops.wsframeraw {
+		// binary frames, no text (utf-8) payload semantics
+		ws.PayloadType = websocket.BinaryFrame
+	}
+	ws.MaxPayloadBytes = cliops.wsmaxrespsize
+	wsconn = wconn
+	return ws, nil
+}
+
+//
+// ConnTuple - return the description of the connection with its transport,
+// local and remote addresses and ip version (the remote address is the one
+// of the http proxy if used)
+func ConnTuple(conn net.Conn, scheme string) string {
+	if _, ok := conn.RemoteAddr().(*net.UnixAddr); ok {
+		return fmt.Sprintf("unix %s (%s)", conn.RemoteAddr(), scheme)
+	}
+	ipver := "IPv6"
+	if ta, ok := conn.RemoteAddr().(*net.TCPAddr); ok && ta.IP.To4() != nil {
+		ipver = "IPv4"
+	}
+	desc := fmt.Sprintf("tcp %s -> %s (%s, %s", conn.LocalAddr(), conn.RemoteAddr(), ipver, scheme)
+	if cliops.wsproxy != "" {
+		desc += ", via proxy"
+	}
+	return desc + ")"
+}
+
+//
+// DialTCP - open the tcp connection to addr, directly or tunneled through
+// the http proxy when it is set - with the unix socket option, the
+// connection is to the socket, addr being ignored
+func DialTCP(addr string) (net.Conn, error) {
+	if cliops.wsunixsock != "" {
+		return net.Dial("unix", cliops.wsunixsock)
+	}
+	var conn net.Conn
+	var err error
+	if cliops.wsproxy == "" {
+		conn, err = net.Dial("tcp", addr)
+	} else {
+		conn, err = ProxyConnect(cliops.wsproxy, addr)
+	}
+	if err == nil && cliops.wskeepalive > 0 {
+		SetTCPKeepAlive(conn)
+	}
+	return conn, err
+}
+
+//
+// SetTCPKeepAlive - enable the tcp keepalive with the period from command
+// line option on the connection, printing the result
+func SetTCPKeepAlive(conn net.Conn) {
+	tconn, ok := conn.(*net.TCPConn)
+	if !ok {
+		PrintWarn("tcp keepalive not enabled - not a tcp connection\n")
+		return
+	}
+	period := time.Duration(cliops.wskeepalive) * time.Millisecond
+	err := tconn.SetKeepAlive(true)
+	if err == nil {
+		err = tconn.SetKeepAlivePeriod(period)
+	}
+	if err != nil {
+		PrintWarn("tcp keepalive not enabled - %v\n", err)
+		return
+	}
+	PrintMsg("TCP keepalive: enabled (period: %v)\n", period)
+}
+
+//
+// ProxyConnect - open a tunnel to addr with a CONNECT request to the http
+// proxy - on 407 with a Basic challenge, the request is sent again with the
+// proxy-auth credentials
+func ProxyConnect(proxy string, addr string) (net.Conn, error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	proxyp, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if proxyp.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", proxyp.Scheme)
+	}
+	paddr := proxyp.Host
+	if _, _, err := net.SplitHostPort(paddr); err != nil {
+		paddr = net.JoinHostPort(paddr, "80")
+	}
+	pauth := ""
+	for {
+		conn, err := net.Dial("tcp", paddr)
+		if err != nil {
+			return nil, err
+		}
+		req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+		if pauth != "" {
+			req += "Proxy-Authorization: " + pauth + "\r\n"
+		}
+		req += "\r\n"
+		if _, err = conn.Write([]byte(req)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode == 200 {
+			if br.Buffered() > 0 {
+				conn.Close()
+				return nil, fmt.Errorf("unexpected data from proxy after CONNECT response")
+			}
+			return conn, nil
+		}
+		conn.Close()
+		if resp.StatusCode != 407 {
+			return nil, fmt.Errorf("proxy CONNECT failed: %s", resp.Status)
+		}
+		challenge := resp.Header.Get("Proxy-Authenticate")
+		if pauth != "" || cliops.wsproxyauth == "" ||
+			!strings.HasPrefix(strings.ToLower(challenge), "basic") {
+			return nil, fmt.Errorf("proxy authentication required: %s", challenge)
+		}
+		PrintMsg("Proxy authentication required: %s - retrying with credentials\n", challenge)
+		pauth = "Basic " + base64.StdEncoding.EncodeToString([]byte(cliops.wsproxyauth))
+	}
+}
+
+//
+// WSProtocols - return the list of sub-protocols for the handshake, with
+// the value advertised exactly as given - none if it is empty
+func WSProtocols(proto string) []string {
+	if proto == "" {
+		return nil
+	}
+	return []string{proto}
+}
+
+//
+// DialURLs - try to open the websocket connection to each of the URLs, in
+// the given order, until one succeeds - return the error of the last attempt
+// if none succeeds
+func DialURLs(urlps []*url.URL, wsc *websocket.Config) (*websocket.Conn, error) {
+	var err error
+	var ws *websocket.Conn
+	if len(urlps) > 1 {
+		PrintMsg("Connection order: %v\n", urlps)
+	}
+	for _, urlp := range urlps {
+		ucfg := *wsc
+		ucfg.Location = urlp
+		ws, err = WSDial(&ucfg)
+		if err == nil {
+			if len(urlps) > 1 {
+				PrintMsg("Connected to: %s\n", urlp)
+			}
+			return ws, nil
+		}
+		if len(urlps) > 1 {
+			PrintMsg("Failed to connect to: %s (%v)\n", urlp, err)
+		}
+	}
+	return nil, err
+}
+
+//
+// WSWriteFrame - write a masked websocket frame directly to the network
+// connection, bypassing the framing done by the websocket library
+func WSWriteFrame(fin bool, opcode byte, payload []byte) error {
+	hdr := []byte{opcode}
+	if fin {
+		hdr[0] |= 0x80
+	}
+	plen := len(payload)
+	switch {
+	case plen <= 125:
+		hdr = append(hdr, 0x80|byte(plen))
+	case plen < 65536:
+		hdr = append(hdr, 0x80|126, byte(plen>>8), byte(plen))
+	default:
+		hdr = append(hdr, 0x80|127)
+		for i := 7; i >= 0; i-- {
+			hdr = append(hdr, byte(uint64(plen)>>uint(8*i)))
+		}
+	}
+	mkey := make([]byte, 4)
+	if _, err := rand.Read(mkey); err != nil {
+		return err
+	}
+	hdr = append(hdr, mkey...)
+	frame := make([]byte, len(hdr)+plen)
+	copy(frame, hdr)
+	for i := 0; i < plen; i++ {
+		frame[len(hdr)+i] = payload[i] ^ mkey[i%4]
+	}
+	_, err := wsconn.Write(frame)
+	return err
+}
+
+//
+// CloseConn - close the websocket connection, sending the close frame with
+// the status code and reason from command line options if set
+func CloseConn(ws *websocket.Conn) {
+	if cliops.wsclosecode == 0 {
+		ws.Close()
+		return
+	}
+	payload := []byte{byte(cliops.wsclosecode >> 8), byte(cliops.wsclosecode)}
+	payload = append(payload, cliops.wsclosereason...)
+	wsconn.SetWriteDeadline(time.Now().Add(time.Duration(cliops.wstimeoutsend) * time.Millisecond))
+	if err := WSWriteFrame(true, websocket.CloseFrame, payload); err != nil {
+		PrintDebug("Failed to send the close frame: %v\n", err)
+	} else {
+		PrintMsg("Sent close frame (status code: %d, reason: '%s')\n", cliops.wsclosecode, cliops.wsclosereason)
+	}
+	wsconn.Close()
+}
+
+//
+// SendData - send the data over the websocket connection, split in many
+// frames if enabled by command line option
+func SendData(ws *websocket.Conn, wmsg []byte) error {
+	tdl := time.Now().Add(time.Duration(cliops.wstimeoutsend) * time.Millisecond)
+	PrintDebug("Write deadline: %s\n", tdl.Format(time.RFC3339Nano))
+	err := ws.SetWriteDeadline(tdl)
+	if err != nil {
+		return err
+	}
+	if (cliops.wsfragment <= 1 && !cliops.wsdrip) || len(wmsg) < 2 {
+		_, err = ws.Write(wmsg)
+		if err == nil {
+			lastSent = wmsg
+			stats.AddSent(len(wmsg))
+			transcript.Write("==> SENT", wmsg)
+			trace.WriteTrace(wsconn.LocalAddr(), wsconn.RemoteAddr(), wmsg)
+		}
+		return err
+	}
+	fsize := cliops.wsdripsize
+	if !cliops.wsdrip {
+		nframes := cliops.wsfragment
+		if nframes > len(wmsg) {
+			nframes = len(wmsg)
+		}
+		fsize = (len(wmsg) + nframes - 1) / nframes
+	}
+	tstart := time.Now()
+	var sizes []int
+	opcode := byte(websocket.TextFrame)
+	if cliops.wsframeraw {
+		opcode = websocket.BinaryFrame
+	}
+	for p := 0; p < len(wmsg); p += fsize {
+		e := p + fsize
+		if e > len(wmsg) {
+			e = len(wmsg)
+		}
+		if cliops.wsdrip && p > 0 {
+			time.Sleep(cliops.wsdripdelay)
+			// the send timeout is for each frame
+			wsconn.SetWriteDeadline(time.Now().Add(time.Duration(cliops.wstimeoutsend) * time.Millisecond))
+		}
+		err = WSWriteFrame(e == len(wmsg), opcode, wmsg[p:e])
+		if err != nil {
+			return err
+		}
+		opcode = websocket.ContinuationFrame
+		sizes = append(sizes, e-p)
+	}
+	lastSent = wmsg
+	stats.AddSent(len(wmsg))
+	transcript.Write("==> SENT", wmsg)
+	trace.WriteTrace(wsconn.LocalAddr(), wsconn.RemoteAddr(), wmsg)
+	if cliops.wsdrip {
+		PrintMsg("Sent data in %d frames of up to %d bytes in %v\n", len(sizes), fsize, time.Since(tstart))
+	} else {
+		PrintMsg("Sent data in %d frames (sizes: %v)\n", len(sizes), sizes)
+	}
+	return nil
+}
+
+//
+// RecvData - receive data from the websocket connection
+func RecvData(ws *websocket.Conn) ([]byte, error) {
+	// no deadline (wait indefinitely) if the timeout is not a positive value
+	var tdl time.Time
+	if cliops.wstimeoutrecv > 0 {
+		tdl = time.Now().Add(time.Duration(cliops.wstimeoutrecv) * time.Millisecond)
+		PrintDebug("Read deadline: %s\n", tdl.Format(time.RFC3339Nano))
+	} else {
+		PrintDebug("Read deadline: none\n")
+	}
+	err := ws.SetReadDeadline(tdl)
+	if err != nil {
+		return nil, err
+	}
+	rmsg, err := ReadMessage(ws)
+	if err != nil {
+		return nil, err
+	}
+	n := len(rmsg)
+	stats.AddRecv(n)
+	transcript.Write("<== RECV", rmsg[:n])
+	trace.WriteTrace(wsconn.RemoteAddr(), wsconn.LocalAddr(), rmsg[:n])
+	RunOnReceive(rmsg[:n])
+	return rmsg[:n], nil
+}
+
+//
+// SendPing - send a websocket ping frame and wait for the pong with the same
+// payload, printing the round-trip time - the execution is stopped if it
+// is not received before the receive timeout
+func SendPing(ws *websocket.Conn) {
+	wconn, ok := wsconn.(*WSNetConn)
+	if !ok {
+		log.Fatal("cannot send ping - unknown connection type")
+	}
+	wconn.pingdata = []byte(cliops.wspingdata)
+	if len(wconn.pingdata) == 0 {
+		wconn.pingdata = []byte(HMD5(RandomKey())[:16])
+	}
+	wconn.pingwait = true
+	tstart := time.Now()
+	if err := WSWriteFrame(true, websocket.PingFrame, wconn.pingdata); err != nil {
+		log.Fatal(err)
+	}
+	PrintMsg("Ping sent (%d bytes payload)\n", len(wconn.pingdata))
+	for {
+		// the read returns only on data, error or when the pong is received
+		rmsg, err := RecvData(ws)
+		if !wconn.pongtime.IsZero() {
+			PrintMsg("Pong received: round-trip time %v\n", wconn.pongtime.Sub(tstart))
+			break
+		}
+		if err != nil {
+			wconn.pingwait = false
+			if os.IsTimeout(err) {
+				PrintMsg("Pong not received before timeout (%dms)\n", cliops.wstimeoutrecv)
+				stats.PrintSummary()
+				os.Exit(exitCodeTimeout)
+			}
+			FatalRecvError(err)
+		}
+		PrintWarn("data received while waiting for the pong (%d bytes) - discarded\n", len(rmsg))
+	}
+}
+
+//
+// ReadMessage - read the next message from the websocket connection - error
+// if it is larger than the max-response-size option
+func ReadMessage(ws *websocket.Conn) ([]byte, error) {
+	var rmsg []byte
+	err := websocket.Message.Receive(ws, &rmsg)
+	if err == websocket.ErrFrameTooLarge {
+		if wconn, ok := wsconn.(*WSNetConn); ok {
+			return nil, fmt.Errorf("received message of %d bytes exceeds the max-response-size cap of %d bytes (%d bytes received)",
+				wconn.flen, cliops.wsmaxrespsize, wconn.flen-wconn.fleft)
+		}
+		return nil, fmt.Errorf("received message exceeds the max-response-size cap of %d bytes", cliops.wsmaxrespsize)
+	}
+	return rmsg, err
+}
+
+//
+// RecvDataRetransmit - receive data from the websocket connection, sending
+// again the same data (same sip transaction) if nothing is received in the
+// sip t1 interval, doubled after each retransmission up to t2, until the
+// receive timeout
+func RecvDataRetransmit(ws *websocket.Conn, wmsg []byte) ([]byte, error) {
+	tmoutrecv := cliops.wstimeoutrecv
+	defer func() { cliops.wstimeoutrecv = tmoutrecv }()
+	var tend time.Time
+	if tmoutrecv > 0 {
+		tend = time.Now().Add(time.Duration(tmoutrecv) * time.Millisecond)
+	}
+	tstart := time.Now()
+	interval := cliops.wssipt1
+	for n := 1; ; n++ {
+		cliops.wstimeoutrecv = interval
+		if !tend.IsZero() {
+			if left := int(time.Until(tend) / time.Millisecond); left < interval {
+				// a zero timeout would wait indefinitely
+				cliops.wstimeoutrecv = left
+				if left < 1 {
+					cliops.wstimeoutrecv = 1
+				}
+			}
+		}
+		rmsg, err := RecvData(ws)
+		// no retransmission in the last millisecond, the timeout of the
+		// next receive cannot be less than that
+		if err == nil || !os.IsTimeout(err) || (!tend.IsZero() && time.Until(tend) < time.Millisecond) {
+			return rmsg, err
+		}
+		err = SendData(ws, wmsg)
+		if err != nil {
+			return nil, err
+		}
+		PrintMsg("Retransmission %d after %v (interval: %dms)\n", n, time.Since(tstart), interval)
+		if interval *= 2; interval > cliops.wssipt2 {
+			interval = cliops.wssipt2
+		}
+	}
+}
+
+//
+// RunOnReceive - execute the on-receive command (if set) with the received
+// data to its stdin - its output goes to stdout and stderr
+func RunOnReceive(rmsg []byte) {
+	if cliops.wsonrecv == "" {
+		return
+	}
+	cmd := exec.Command("sh", "-c", cliops.wsonrecv)
+	cmd.Stdin = bytes.NewReader(rmsg)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err == nil {
+		PrintDebug("On-receive command succeeded\n")
+		return
+	}
+	code := -1
+	if eerr, ok := err.(*exec.ExitError); ok {
+		code = eerr.ExitCode()
+	}
+	PrintWarn("on-receive command failed (exit code: %d): %v\n", code, err)
+	if cliops.wsonrecvfail {
+		stats.PrintSummary()
+		os.Exit(exitCodeCommand)
+	}
+}
+
+//
+// SendRecvData - send the data to ws server and receive the response (with
+// resending on timeout, following sip redirects and doing sip auth if
+// enabled) - return the last received response (nil if not receiving)
+func SendRecvData(ws *websocket.Conn, wmsg []byte) []byte {
+	// send data to ws server
+	err := SendData(ws, wmsg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	PrintMsg("Sending (%d bytes):\n[[%s]]\n", len(wmsg), DisplayData(wmsg))
+	PrintRequest(wmsg)
+
+	// receive data from ws server
+	if cliops.wsreceive {
+		ReadDelay()
+		var rmsg []byte
+		for r := 0; ; r++ {
+			if cliops.wsproto == "sip" && cliops.wsretransmit && SIPRequestMethod(wmsg) != "" {
+				rmsg, err = RecvDataRetransmit(ws, wmsg)
+			} else {
+				rmsg, err = RecvData(ws)
+			}
+			if err == nil {
+				if r > 0 {
+					PrintMsg("Response received after %d retries\n", r)
+				}
+				break
+			}
+			if !os.IsTimeout(err) || r >= cliops.wsretrytmout {
+				FatalRecvError(err)
+			}
+			// resend the data - for sip it is a new transaction
+			stats.AddRetry()
+			if cliops.wsproto == "sip" {
+				wmsg = SIPNewViaBranch(SIPIncCSeq(wmsg))
+			}
+			err = SendData(ws, wmsg)
+			if err != nil {
+				log.Fatal(err)
+			}
+			PrintMsg("Resending after timeout (retry %d of %d) (%d bytes):\n[[%s]]\n", r+1, cliops.wsretrytmout, len(wmsg), DisplayData(wmsg))
+			PrintRequest(wmsg)
+		}
+		PrintRecvData(fmt.Sprintf("Receiving (%d bytes):", len(rmsg)), rmsg)
+		if ph, ok := protocolHandlers[cliops.wsproto]; ok {
+			rmsg, _ = ph.HandleResponse(ws, wmsg, rmsg)
+		}
+		return rmsg
+	}
+	return nil
+}
+
+//
+// RegisterRefresh - resend the SIP REGISTER request at the refresh ratio of
+// the expires granted in the last response, until interrupted or a refresh
+// fails - each refresh is a new transaction, authenticated if challenged
+func RegisterRefresh(ws *websocket.Conn, wmsg []byte, rmsg []byte) {
+	if SIPRequestMethod(wmsg) != "REGISTER" {
+		log.Fatal("the option '--sip-register-refresh' requires a sip register request")
+	}
+	for n := 1; ; n++ {
+		code := SIPStatusCode(rmsg)
+		if code < 200 || code > 299 {
+			PrintMsg("Register refresh: stopped - response status code %d\n", code)
+			stats.PrintSummary()
+			os.Exit(1)
+		}
+		expires := SIPExpires(rmsg)
+		if expires <= 0 {
+			PrintMsg("Register refresh: stopped - no expires granted in the response\n")
+			stats.PrintSummary()
+			os.Exit(1)
+		}
+		wait := time.Duration(float64(expires) * cliops.wsrefreshrat * float64(time.Second))
+		PrintMsg("Register refresh: expires %ds granted, refresh %d in %v\n", expires, n, wait)
+		time.Sleep(wait)
+		// next cseq after the one of the last sent request (can be
+		// an authenticated one), without the previous credentials
+		wmsg = SIPNewViaBranch(SIPSetCSeqNumber(wmsg, SIPCSeqNumber(lastSent)+1))
+		tstart := time.Now()
+		rmsg = SendRecvData(ws, wmsg)
+		PrintMsg("Register refresh %d: status code %d in %v\n", n, SIPStatusCode(rmsg), time.Since(tstart))
+	}
+}
+
+//
+// ValidateSIPMessage - print the result of checking the SIP message to be
+// sent and exit with 1 if it has problems
+func ValidateSIPMessage(wmsg []byte) {
+	problems := SIPCheckMessage(wmsg)
+	if len(problems) == 0 {
+		PrintMsg("Validation: OK\n")
+		return
+	}
+	PrintMsg("Validation: FAILED\n")
+	for _, p := range problems {
+		PrintMsg("  - %s\n", p)
+	}
+	os.Exit(1)
+}
+
+//
+// CheckExpect - check the response against the expectations given in command
+// line and exit with exitCodeExpect if one fails
+func CheckExpect(rmsg []byte) {
+	if rmsg == nil {
+		PrintMsg("Expectation failed: no response received\n")
+		stats.PrintSummary()
+		os.Exit(exitCodeExpect)
+	}
+	// all expectations are checked, to report all the failures
+	nfailed := 0
+	if expectMatch != nil {
+		m := expectMatch.Find(rmsg)
+		if m == nil {
+			PrintMsg("Expectation failed: response does not match '%s'\n", expectMatch)
+			nfailed++
+		} else {
+			PrintMsg("Expectation ok: response matches '%s' (matched: %q)\n", expectMatch, m)
+		}
+	}
+	if expectNotMatch != nil {
+		m := expectNotMatch.Find(rmsg)
+		if m != nil {
+			PrintMsg("Expectation failed: response matches '%s' (matched: %q)\n", expectNotMatch, m)
+			nfailed++
+		} else {
+			PrintMsg("Expectation ok: response does not match '%s'\n", expectNotMatch)
+		}
+	}
+	if expectFile != nil {
+		diff := UnifiedDiff(DiffLines(expectFile), DiffLines(rmsg), cliops.wsexpfile, "response")
+		if diff != "" {
+			PrintMsg("Expectation failed: response differs from '%s'\n%s", cliops.wsexpfile, diff)
+			nfailed++
+		} else {
+			PrintMsg("Expectation ok: response matches '%s'\n", cliops.wsexpfile)
+		}
+	}
+	for _, rule := range expectRules {
+		ok, val := rule.Check(rmsg)
+		if !ok {
+			PrintMsg("Expectation failed: '%s' (value: %s)\n", rule.text, val)
+			nfailed++
+		} else {
+			PrintMsg("Expectation ok: '%s' (value: %s)\n", rule.text, val)
+		}
+	}
+	if nfailed > 0 {
+		PrintMsg("Expectations failed: %d\n", nfailed)
+		stats.PrintSummary()
+		os.Exit(exitCodeExpect)
+	}
+}
+
+//
+// DiffLines - return the lines of the message to be compared with the expect
+// file, without line terminators and without the ignored headers
+func DiffLines(msg []byte) []string {
+	var lines []string
+	inheaders := true
+	for i, line := range strings.Split(string(unfoldHeaders(msg)), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			inheaders = false
+		}
+		if i > 0 && inheaders {
+			if c := strings.IndexByte(line, ':'); c > 0 && diffIgnoreHeaders[strings.ToLower(strings.TrimSpace(line[:c]))] {
+				continue
+			}
+		}
+		lines = append(lines, line)
+	}
+	// no extra empty line for the last line terminator
+	if len(lines) > 0 && lines[len(lines)-1] == "" && bytes.HasSuffix(msg, []byte("\n")) {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+//
+// UnifiedDiff - return the differences between the lines of a and b in
+// unified format (3 lines of context), empty if they are the same - based
+// on the longest common subsequence of the lines
+func UnifiedDiff(a []string, b []string, aname string, bname string) string {
+	n, m := len(a), len(b)
+	// lcs[i][j] - length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	// edit operations, with the positions in a and b before each of them
+	type diffOp struct {
+		kind   byte
+		text   string
+		ai, bi int
+	}
+	var ops []diffOp
+	var changes []int
+	for i, j := 0, 0; i < n || j < m; {
+		switch {
+		case i < n && j < m && a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i], i, j})
+			i++
+			j++
+		case i < n && (j == m || lcs[i+1][j] >= lcs[i][j+1]):
+			changes = append(changes, len(ops))
+			ops = append(ops, diffOp{'-', a[i], i, j})
+			i++
+		default:
+			changes = append(changes, len(ops))
+			ops = append(ops, diffOp{'+', b[j], i, j})
+			j++
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+	const context = 3
+	var obuf bytes.Buffer
+	fmt.Fprintf(&obuf, "--- %s\n+++ %s\n", aname, bname)
+	for k := 0; k < len(changes); {
+		// hunk with the changes closer than two contexts
+		hs := changes[k] - context
+		if hs < 0 {
+			hs = 0
+		}
+		for k+1 < len(changes) && changes[k+1]-changes[k] <= 2*context {
+			k++
+		}
+		he := changes[k] + context + 1
+		if he > len(ops) {
+			he = len(ops)
+		}
+		k++
+		acount, bcount := 0, 0
+		for _, op := range ops[hs:he] {
+			if op.kind != '+' {
+				acount++
+			}
+			if op.kind != '-' {
+				bcount++
+			}
+		}
+		astart, bstart := ops[hs].ai, ops[hs].bi
+		if acount > 0 {
+			astart++
+		}
+		if bcount > 0 {
+			bstart++
+		}
+		fmt.Fprintf(&obuf, "@@ -%d,%d +%d,%d @@\n", astart, acount, bstart, bcount)
+		for _, op := range ops[hs:he] {
+			fmt.Fprintf(&obuf, "%c%s\n", op.kind, op.text)
+		}
+	}
+	return obuf.String()
+}
+
+//
+// ParseExpectRule - return the rule from its text: 'status' followed by a
+// comparison with a number, 'header:Name' alone (present), prefixed by '!'
+// (not present) or followed by a comparison or a regular expression match
+// ('~=') or not match ('!~'), 'body' followed by a comparison or a regular
+// expression match
+func ParseExpectRule(text string) (ExpectRule, error) {
+	rule := ExpectRule{text: text}
+	expr := strings.TrimSpace(text)
+	negated := strings.HasPrefix(expr, "!")
+	if negated {
+		// only header presence can be negated
+		rule.op = "!"
+		expr = strings.TrimSpace(expr[1:])
+	}
+	opos := -1
+	for _, op := range expectOperators {
+		if p := strings.Index(expr, op); p >= 0 && (opos < 0 || p < opos) {
+			opos = p
+			rule.op = op
+		}
+	}
+	subject := expr
+	if opos >= 0 {
+		if negated {
+			return rule, fmt.Errorf("invalid expect rule: '%s' (only header presence can be negated)", text)
+		}
+		subject = strings.TrimSpace(expr[:opos])
+		rule.value = strings.TrimSpace(expr[opos+len(rule.op):])
+	}
+	switch {
+	case subject == "status" || subject == "body":
+		rule.subject = subject
+	case strings.HasPrefix(subject, "header:") && len(subject) > len("header:"):
+		rule.subject = "header"
+		rule.hname = strings.TrimSpace(subject[len("header:"):])
+	default:
+		return rule, fmt.Errorf("invalid expect rule: '%s' (must start with status, header:Name or body)", text)
+	}
+	if rule.op == "" || rule.op == "!" {
+		if rule.subject != "header" {
+			return rule, fmt.Errorf("invalid expect rule: '%s' (missing operator)", text)
+		}
+		return rule, nil
+	}
+	switch rule.op {
+	case "~=", "!~":
+		if rule.subject == "status" {
+			return rule, fmt.Errorf("invalid expect rule: '%s' (status requires a comparison)", text)
+		}
+		re, err := regexp.Compile(rule.value)
+		if err != nil {
+			return rule, fmt.Errorf("invalid expect rule: '%s' (%v)", text, err)
+		}
+		rule.re = re
+	case ">=", "<=", ">", "<":
+		if _, err := strconv.Atoi(rule.value); err != nil {
+			return rule, fmt.Errorf("invalid expect rule: '%s' (number required for '%s')", text, rule.op)
+		}
+	default:
+		if rule.subject == "status" {
+			if _, err := strconv.Atoi(rule.value); err != nil {
+				return rule, fmt.Errorf("invalid expect rule: '%s' (status has to be compared with a number)", text)
+			}
+		}
+	}
+	return rule, nil
+}
+
+//
+// Check - return true if the response satisfies the rule, and the value it
+// was checked against
+func (rule ExpectRule) Check(rmsg []byte) (bool, string) {
+	var val string
+	switch rule.subject {
+	case "status":
+		val = strconv.Itoa(SIPStatusCode(rmsg))
+	case "header":
+		msg := unfoldHeaders(rmsg)
+		s, e := SIPHeaderBounds(msg, rule.hname)
+		if s < 0 {
+			return rule.op == "!", "<none>"
+		}
+		val = strings.TrimSpace(string(msg[s+bytes.IndexByte(msg[s:e], ':')+1 : e]))
+		if rule.op == "" || rule.op == "!" {
+			return rule.op == "", strconv.Quote(val)
+		}
+	case "body":
+		val = string(rmsg)
+		if p := bytes.Index(rmsg, []byte("\r\n\r\n")); p >= 0 {
+			val = string(rmsg[p+4:])
+		} else if p := bytes.Index(rmsg, []byte("\n\n")); p >= 0 {
+			val = string(rmsg[p+2:])
+		}
+	}
+	switch rule.op {
+	case "==":
+		return val == rule.value, strconv.Quote(val)
+	case "!=":
+		return val != rule.value, strconv.Quote(val)
+	case "~=":
+		return rule.re.MatchString(val), strconv.Quote(val)
+	case "!~":
+		return !rule.re.MatchString(val), strconv.Quote(val)
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return false, strconv.Quote(val)
+	}
+	v, _ := strconv.Atoi(rule.value)
+	switch rule.op {
+	case ">=":
+		return n >= v, val
+	case "<=":
+		return n <= v, val
+	case ">":
+		return n > v, val
+	}
+	return n < v, val
+}
+
+//
+// ExpectClose - send the data and check that the server closes the
+// connection before the receive timeout, reporting if it was done with a
+// close frame or only at tcp level - exit with 0 if the connection was
+// closed, with exitCodeExpect if not
+func ExpectClose(ws *websocket.Conn, wmsg []byte) {
+	if len(wmsg) > 0 {
+		err := SendData(ws, wmsg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		PrintMsg("Sending (%d bytes):\n[[%s]]\n", len(wmsg), DisplayData(wmsg))
+		PrintRequest(wmsg)
+	}
+	ret := 0
+	rmsg, err := RecvData(ws)
+	switch {
+	case err == io.EOF:
+		if c, ok := wsconn.(*WSNetConn); ok && c.closeframe {
+			PrintMsg("Expectation ok: connection closed by server with close frame (status code: %d)\n", c.closecode)
+		} else {
+			PrintMsg("Expectation ok: connection closed by server without close frame (tcp close)\n")
+		}
+	case errors.Is(err, syscall.ECONNRESET):
+		PrintMsg("Expectation ok: connection reset by server without close frame (tcp reset)\n")
+	case err == nil:
+		PrintRecvData(fmt.Sprintf("Receiving (%d bytes):", len(rmsg)), rmsg)
+		PrintMsg("Expectation failed: data received instead of connection close\n")
+		ret = exitCodeExpect
+	case os.IsTimeout(err):
+		PrintMsg("Expectation failed: connection not closed before timeout\n")
+		ret = exitCodeExpect
+	default:
+		PrintMsg("Expectation failed: error receiving data (%v)\n", err)
+		ret = exitCodeExpect
+	}
+	stats.PrintSummary()
+	os.Exit(ret)
+}
+
+//
+// ProtocolHandler - processing of the responses specific to a websocket
+// sub-protocol (e.g., authentication) - HandleResponse gets the sent and the
+// received data, returning the last received response and true if it did a
+// follow up over the connection
+type ProtocolHandler interface {
+	HandleResponse(ws *websocket.Conn, wmsg []byte, rmsg []byte) ([]byte, bool)
+}
+
+// handlers of the responses by sub-protocol name
+var protocolHandlers = map[string]ProtocolHandler{
+	"sip": SIPHandler{},
+}
+
+//
+// SIPHandler - processing of SIP responses
+type SIPHandler struct{}
+
+//
+// HandleResponse - print nat details, follow redirects and do the
+// authentication, as enabled by command line options
+func (h SIPHandler) HandleResponse(ws *websocket.Conn, wmsg []byte, rmsg []byte) ([]byte, bool) {
+	followed := false
+	if cliops.wsshownat {
+		vrecv, vrport := SIPViaNATParams(rmsg)
+		PrintMsg("NAT details from top Via: received=%s rport=%s\n", vrecv, vrport)
+	}
+	if cliops.wssdpsummary {
+		if code := SIPStatusCode(rmsg); code >= 100 && code < 300 {
+			for _, l := range SDPSummary(SIPBody(rmsg)) {
+				PrintMsg("%s\n", l)
+			}
+		}
+	}
+	if SIPStatusCode(rmsg) == 420 {
+		SIPPrintBadExtension(wmsg, rmsg)
+	}
+	if code := SIPStatusCode(rmsg); code > 0 {
+		scode := strconv.Itoa(code)
+		for _, c := range failOnCodes {
+			if c == scode || (c[1:] == "xx" && c[0] == scode[0]) {
+				PrintMsg("Fail-on: response with status code %d matches '%s'\n", code, c)
+				stats.PrintSummary()
+				os.Exit(exitCodeExpect)
+			}
+		}
+	}
+	if cliops.wsredirect {
+		var nmsg []byte
+		nmsg, rmsg = FollowSIPRedirects(ws, wmsg, rmsg)
+		followed = !bytes.Equal(nmsg, wmsg)
+		wmsg = nmsg
+	}
+	if !cliops.wsnoautoauth && isSIPResponse(rmsg) {
+		if amsg, ok := ManageSIPResponse(ws, wmsg, rmsg); ok {
+			return amsg, true
+		}
+	}
+	return rmsg, followed
+}
+
+//
+// SIPPrintBadExtension - print the option tags rejected by the server in the
+// Unsupported header of the 420 response, with the ones required by the
+// Require and Proxy-Require headers of the sent request
+func SIPPrintBadExtension(wmsg []byte, rmsg []byte) {
+	tags := SIPOptionTags(unfoldHeaders(rmsg), "Unsupported")
+	if len(tags) == 0 {
+		PrintMsg("Bad extension: the 420 response has no Unsupported header\n")
+	} else {
+		PrintMsg("Bad extension: option tags not supported by the server: %s\n", strings.Join(tags, ", "))
+	}
+	umsg := unfoldHeaders(wmsg)
+	for _, hname := range []string{"Require", "Proxy-Require"} {
+		if rtags := SIPOptionTags(umsg, hname); len(rtags) > 0 {
+			PrintMsg("Bad extension: %s of the sent request: %s\n", hname, strings.Join(rtags, ", "))
+		}
+	}
+}
+
+//
+// SIPOptionTags - return the option tags of all the headers with the name
+// hname (e.g., Require), each header having a comma separated list of them
+func SIPOptionTags(msg []byte, hname string) []string {
+	var tags []string
+	for _, hval := range SIPHeaderValues(msg, hname) {
+		for _, t := range strings.Split(hval, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tags = append(tags, t)
+			}
+		}
+	}
+	return tags
+}
+
+//
+// ScenarioStep - a step of the scenario file
+type ScenarioStep struct {
+	// path to data template file (relative to scenario file directory) - if
+	// empty, the step only receives data
+	Template string `json:"template"`
+	// receive timeout (milliseconds) - if not set, --timeout-recv is used
+	TimeoutRecv *int `json:"timeout-recv"`
+	// wait for response after sending - if not set, --receive is used
+	Receive *bool `json:"receive"`
+}
+
+//
+// RunScenario - execute the steps of the scenario over the ws connection -
+// if redial is not nil, each step sending data after the first one is done
+// over a new connection (with new template functions, restarting the seq
+// counter); return the last used connection
+func RunScenario(ws *websocket.Conn, redial func() (*websocket.Conn, error), steps []ScenarioStep, sdir string, tplfields interface{}, tfuncs template.FuncMap) *websocket.Conn {
+	tmoutrecv := cliops.wstimeoutrecv
+	wsreceive := cliops.wsreceive
+	nsent := 0
+	for i, step := range steps {
+		// step specific options
+		cliops.wstimeoutrecv = tmoutrecv
+		if step.TimeoutRecv != nil {
+			cliops.wstimeoutrecv = *step.TimeoutRecv
+		}
+		cliops.wsreceive = wsreceive
+		if step.Receive != nil {
+			cliops.wsreceive = *step.Receive
+		}
+		PrintMsg("Scenario step %d of %d (timeout-recv: %dms)\n", i+1, len(steps), cliops.wstimeoutrecv)
+		if step.Template == "" {
+			rmsg, err := RecvData(ws)
+			if err != nil {
+				FatalRecvError(err)
+			}
+			PrintRecvData(fmt.Sprintf("Receiving (%d bytes):", len(rmsg)), rmsg)
+			continue
+		}
+		tpath := step.Template
+		if !filepath.IsAbs(tpath) {
+			tpath = filepath.Join(sdir, tpath)
+		}
+		tpldata, err := ioutil.ReadFile(tpath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if redial != nil && nsent > 0 {
+			// the data of the step is sent over a new connection
+			tfuncs = NewTemplateFuncs()
+		}
+		wmsg, err := BuildMessage(string(tpldata), filepath.Dir(tpath), tplfields, tfuncs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if cliops.wsvalidate {
+			ValidateSIPMessage(wmsg)
+		}
+		if redial != nil && nsent > 0 {
+			ws.Close()
+			tconnect := time.Now()
+			ws, err = redial()
+			if err != nil {
+				log.Fatal(err)
+			}
+			PrintMsg("New connection for step %d established in %v\n", i+1, time.Since(tconnect))
+		}
+		nsent++
+		if cliops.wsproto == "sip" && cliops.wsfixcontact {
+			wmsg = SIPFixContact(wmsg, wsconn.LocalAddr())
+		}
+		SendRecvData(ws, wmsg)
+	}
+	cliops.wstimeoutrecv = tmoutrecv
+	cliops.wsreceive = wsreceive
+	return ws
+}
+
+//
+// RunInteractive - send the lines typed at the prompt (or the data of the
+// template file with 'send <file>') over the ws connection, printing the
+// received data asynchronously, until 'quit' command or end of input
+func RunInteractive(ws *websocket.Conn, tplfields interface{}, tfuncs template.FuncMap) {
+	// closed when the connection is closed locally
+	done := make(chan struct{})
+	go func() {
+		for {
+			ws.SetReadDeadline(time.Time{})
+			rmsg, err := ReadMessage(ws)
+			n := len(rmsg)
+			if err != nil {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if err == io.EOF {
+					PrintMsg("Connection closed by server\n")
+					stats.PrintSummary()
+					os.Exit(0)
+				}
+				log.Fatal(err)
+			}
+			stats.AddRecv(n)
+			transcript.Write("<== RECV", rmsg[:n])
+			trace.WriteTrace(wsconn.RemoteAddr(), wsconn.LocalAddr(), rmsg[:n])
+			PrintMsg("\n")
+			PrintRecvData(fmt.Sprintf("Receiving (%d bytes):", n), rmsg[:n])
+			RunOnReceive(rmsg[:n])
+		}
+	}()
+
+	fmt.Printf("Interactive mode - commands:\n")
+	fmt.Printf("    send <file> - send the data of the template file\n")
+	fmt.Printf("    quit        - close the connection and exit\n")
+	fmt.Printf("    any other line is sent as it is\n\n")
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Printf("wsctl> ")
+		if !scanner.Scan() {
+			break
+		}
+		line := scanner.Text()
+		var wmsg []byte
+		switch {
+		case line == "":
+			continue
+		case line == "quit":
+			close(done)
+			CloseConn(ws)
+			PrintMsg("Connection closed\n")
+			return
+		case strings.HasPrefix(line, "send "):
+			tpath := strings.TrimSpace(line[5:])
+			tpldata, err := ioutil.ReadFile(tpath)
+			if err != nil {
+				fmt.Printf("error: %v\n", err)
+				continue
+			}
+			wmsg, err = BuildMessage(string(tpldata), filepath.Dir(tpath), tplfields, tfuncs)
+			if err != nil {
+				fmt.Printf("error: %v\n", err)
+				continue
+			}
+		default:
+			wmsg = []byte(line)
+		}
+		err := SendData(ws, wmsg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		PrintMsg("Sending (%d bytes):\n[[%s]]\n", len(wmsg), DisplayData(wmsg))
+	}
+	close(done)
+	CloseConn(ws)
+	PrintMsg("Connection closed\n")
+}
+
+//
+// HealthCheck - send the data and check the response - for sip it has to be
+// a 2xx reply; with no data, the connection is considered enough - return
+// the exit code (0 if ok, 1 if not)
+func HealthCheck(ws *websocket.Conn, wmsg []byte) int {
+	if len(wmsg) == 0 {
+		PrintMsg("Healthcheck: OK (connected)\n")
+		return 0
+	}
+	err := SendData(ws, wmsg)
+	if err != nil {
+		PrintMsg("Healthcheck: FAILED (sending: %v)\n", err)
+		return 1
+	}
+	PrintMsg("Sending (%d bytes):\n[[%s]]\n", len(wmsg), DisplayData(wmsg))
+	rmsg, err := RecvData(ws)
+	if err != nil {
+		PrintMsg("Healthcheck: FAILED (receiving: %v)\n", err)
+		return 1
+	}
+	PrintRecvData(fmt.Sprintf("Receiving (%d bytes):", len(rmsg)), rmsg)
+	if cliops.wsproto != "sip" {
+		PrintMsg("Healthcheck: OK (response received)\n")
+		return 0
+	}
+	code := SIPStatusCode(rmsg)
+	if code < 200 || code > 299 {
+		PrintMsg("Healthcheck: FAILED (status code: %d)\n", code)
+		return 1
+	}
+	PrintMsg("Healthcheck: OK (status code: %d)\n", code)
+	return 0
+}
+
+//
+// ListenData - receive data from the websocket connection until it is
+// closed by the server or the limit of received messages is reached
+func ListenData(ws *websocket.Conn) {
+	if lastSent == nil {
+		// otherwise done after sending
+		ReadDelay()
+	}
+	tmoutrecv := cliops.wstimeoutrecv
+	defer func() { cliops.wstimeoutrecv = tmoutrecv }()
+	nka := 0
+	tka := time.Now().Add(cliops.wskaoptions)
+	for cnt := 1; cliops.wsmaxrecv <= 0 || cnt <= cliops.wsmaxrecv; cnt++ {
+		cliops.wstimeoutrecv = tmoutrecv
+		if cliops.wsduration > 0 {
+			// receive timeout limited to the end of the run
+			remaining := cliops.wsduration - time.Since(stats.start)
+			if remaining <= 0 {
+				PrintMsg("Duration of %v reached\n", cliops.wsduration)
+				return
+			}
+			if tmoutrecv <= 0 || time.Duration(tmoutrecv)*time.Millisecond > remaining {
+				cliops.wstimeoutrecv = int((remaining + time.Millisecond - 1) / time.Millisecond)
+			}
+		}
+		kawait := false
+		if cliops.wskaoptions > 0 {
+			untilka := time.Until(tka)
+			if untilka <= 0 {
+				// not counted as received message
+				nka++
+				cliops.wstimeoutrecv = tmoutrecv
+				SIPKeepaliveOptions(ws, nka)
+				tka = time.Now().Add(cliops.wskaoptions)
+				cnt--
+				continue
+			}
+			// receive timeout limited to the next keepalive
+			if cliops.wstimeoutrecv <= 0 || time.Duration(cliops.wstimeoutrecv)*time.Millisecond > untilka {
+				cliops.wstimeoutrecv = int((untilka + time.Millisecond - 1) / time.Millisecond)
+				kawait = true
+			}
+		}
+		rmsg, err := RecvData(ws)
+		if err != nil {
+			if err == io.EOF {
+				// expected when listening
+				PrintMsg("Connection closed by server\n")
+				return
+			}
+			if os.IsTimeout(err) && cliops.wsduration > 0 && time.Since(stats.start) >= cliops.wsduration {
+				PrintMsg("Duration of %v reached\n", cliops.wsduration)
+				return
+			}
+			if os.IsTimeout(err) && kawait {
+				cnt--
+				continue
+			}
+			FatalRecvError(err)
+		}
+		if cliops.wsmaxrecv > 0 {
+			PrintRecvData(fmt.Sprintf("Listen receiving %d of %d (%d bytes):", cnt, cliops.wsmaxrecv, len(rmsg)), rmsg)
+		} else {
+			PrintRecvData(fmt.Sprintf("Listen receiving %d (%d bytes):", cnt, len(rmsg)), rmsg)
+		}
+		if cliops.wsoutputdir != "" {
+			fpath := filepath.Join(cliops.wsoutputdir, fmt.Sprintf("msg-%04d.txt", cnt))
+			err = ioutil.WriteFile(fpath, rmsg, 0644)
+			if err != nil {
+				log.Fatal(err)
+			}
+			PrintMsg("Message written to: %s\n", fpath)
+		}
+		if cliops.wsproto == "sip" && cliops.wsauto200 {
+			mth := SIPRequestMethod(rmsg)
+			for _, m := range strings.Split(cliops.wsauto200mth, ",") {
+				if mth != "" && strings.EqualFold(strings.TrimSpace(m), mth) {
+					smsg := SIPBuildResponse(rmsg, "200 OK")
+					err = SendData(ws, smsg)
+					if err != nil {
+						log.Fatal(err)
+					}
+					PrintMsg("Auto-replying to %s (%d bytes):\n[[%s]]\n", mth, len(smsg), DisplayData(smsg))
+					break
+				}
+			}
+		}
+	}
+	PrintMsg("Limit of %d received messages reached\n", cliops.wsmaxrecv)
+}
+
+//
+// SIPKeepaliveOptions - send a sip options request and receive the response
+// (authenticating if challenged), printing its status code
+func SIPKeepaliveOptions(ws *websocket.Conn, nka int) {
+	sipdomain := cliops.wssipdomain
+	if sipdomain == "" {
+		if u, err := url.Parse(cliops.wsurl); err == nil {
+			sipdomain = u.Hostname()
+		}
+	}
+	// new transaction and call for each keepalive
+	kmsg := HealthcheckMessage(sipdomain)
+	tstart := time.Now()
+	rmsg := SendRecvData(ws, []byte(kmsg))
+	PrintMsg("Keepalive %d: status code %d in %v\n", nka, SIPStatusCode(rmsg), time.Since(tstart))
+}
+
+//
+// HealthcheckMessage - build the sip options request of the healthcheck
+// template for the domain, with a new transaction and call
+func HealthcheckMessage(sipdomain string) string {
+	return strings.Replace(fmt.Sprintf(healthcheckTemplate, HMD5(RandomKey())[:16]), "{{.sipdomain}}", sipdomain, -1)
+}
+
+//
+// ReadDelay - wait the time set by the read-delay option before reading
+func ReadDelay() {
+	if cliops.wsreaddelay <= 0 {
+		return
+	}
+	PrintMsg("Delaying the read for %dms\n", cliops.wsreaddelay)
+	time.Sleep(time.Duration(cliops.wsreaddelay) * time.Millisecond)
+}
+
+//
+// FatalRecvError - print the reason of failing to receive data and exit,
+// with distinct codes for connection closed by server and timeout
+func FatalRecvError(err error) {
+	if err == io.EOF {
+		log.Printf("connection closed by server")
+		stats.PrintSummary()
+		os.Exit(exitCodeClosed)
+	}
+	if os.IsTimeout(err) {
+		log.Printf("timeout waiting to receive data")
+		stats.PrintSummary()
+		os.Exit(exitCodeTimeout)
+	}
+	log.Fatal(err)
+}
+
+//
+// BuildMessage - render the data template with the fields (unless the raw
+// option is set, or with the render command if set) and apply the changes
+// to the result enabled by command line options - tpldir is the directory
+// for the relative paths of files inlined by the template
+func BuildMessage(tplstr string, tpldir string, tplfields interface{}, tfuncs template.FuncMap) ([]byte, error) {
+	var data []byte
+	if cliops.wsraw {
+		// used as it is, no template processing
+		data = []byte(tplstr)
+	} else if cliops.wsrendercmd != "" {
+		var err error
+		data, err = RenderCommand(cliops.wsrendercmd, tplfields)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		data, err = RenderTemplate(tplstr, tpldir, tplfields, tfuncs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cliops.wshex {
+		// raw bytes sent as they are
+		return DecodeHex(data)
+	}
+	wmsg := data
+	if cliops.wscrlf {
+		wmsg = ToCRLF(wmsg)
+	} else if cliops.wslf {
+		wmsg = ToLF(wmsg)
+	}
+	if cliops.wsproto == "sip" && cliops.wssipdomruri && cliops.wssipdomain != "" && !isSIPResponse(wmsg) {
+		wmsg = SIPSetRURIHost(wmsg, cliops.wssipdomain)
+	}
+	if cliops.wsproto == "sip" && cliops.wssipmethod != "" && !isSIPResponse(wmsg) {
+		wmsg = SIPSetMethod(wmsg, cliops.wssipmethod)
+	}
+	if cliops.wsproto == "sip" && cliops.wsmaxfwd > 0 && SIPRequestMethod(wmsg) != "" {
+		if s, _ := SIPHeaderBounds(wmsg, "Max-Forwards"); s < 0 {
+			wmsg = SIPAddHeader(wmsg, "Max-Forwards: "+strconv.Itoa(cliops.wsmaxfwd))
+			PrintMsg("Inserted header 'Max-Forwards: %d' in the sip request\n", cliops.wsmaxfwd)
+		}
+	}
+	if cliops.wsproto == "sip" && cliops.wssipcorrid && SIPRequestMethod(wmsg) != "" {
+		if s, _ := SIPHeaderBounds(wmsg, "X-Correlation-ID"); s < 0 {
+			wmsg = SIPAddHeader(wmsg, "X-Correlation-ID: "+correlationID)
+		}
+	}
+	return wmsg, nil
+}
+
+//
+// SplitMessages - return the messages of the content of a messages file:
+// the blocks separated by form feed characters (the line terminator after
+// the form feed is skipped) if it has any, otherwise the lines - empty
+// lines and blocks are ignored
+func SplitMessages(mdata string) []string {
+	var parts []string
+	if strings.Contains(mdata, "\f") {
+		for _, b := range strings.Split(mdata, "\f") {
+			b = strings.TrimPrefix(strings.TrimPrefix(b, "\r"), "\n")
+			if strings.TrimSpace(b) != "" {
+				parts = append(parts, b)
+			}
+		}
+		return parts
+	}
+	for _, l := range strings.Split(mdata, "\n") {
+		l = strings.TrimRight(l, "\r")
+		if l != "" {
+			parts = append(parts, l)
+		}
+	}
+	return parts
+}
+
+//
+// RenderCommand - run the shell command with the fields as json on its stdin
+// and return its stdout as the rendered data - fails if the command exits
+// with non-zero code, giving its stderr
+func RenderCommand(rcmd string, tplfields interface{}) ([]byte, error) {
+	fdata, err := json.Marshal(tplfields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode the fields for render command: %v", err)
+	}
+	var obuf, ebuf bytes.Buffer
+	cmd := exec.Command("sh", "-c", rcmd)
+	cmd.Stdin = bytes.NewReader(fdata)
+	cmd.Stdout = &obuf
+	cmd.Stderr = &ebuf
+	if err = cmd.Run(); err != nil {
+		code := -1
+		if eerr, ok := err.(*exec.ExitError); ok {
+			code = eerr.ExitCode()
+		}
+		return nil, fmt.Errorf("render command failed (exit code: %d): %v\n%s", code, err, ebuf.String())
+	}
+	if ebuf.Len() > 0 {
+		PrintDebug("Render command stderr:\n%s", ebuf.String())
+	}
+	PrintDebug("Render command output: %d bytes\n", obuf.Len())
+	return obuf.Bytes(), nil
+}
+
+//
+// RenderTemplate - execute the data template with the fields - tpldir is
+// the directory for the relative paths of files inlined by the template; the
+// output is not escaped (text/template), the field values are kept as they are
+func RenderTemplate(tplstr string, tpldir string, tplfields interface{}, tfuncs template.FuncMap) ([]byte, error) {
+	tpl, err := template.New("wsout").Delims(tplDelimLeft, tplDelimRight).Funcs(tfuncs).Funcs(template.FuncMap{
+		// content of a file, to keep large bodies outside of the template
+		"readfile": func(fpath string) (string, error) {
+			if !filepath.IsAbs(fpath) {
+				fpath = filepath.Join(tpldir, fpath)
+			}
+			d, err := ioutil.ReadFile(fpath)
+			if err != nil {
+				return TemplateFuncError("readfile", err)
+			}
+			return string(d), nil
+		},
+	}).Parse(tplstr)
+	if err != nil {
+		return nil, err
+	}
+	if cliops.wsstricttpl || cliops.wsreqfields {
+		tpl.Option("missingkey=error")
+	}
+	var buf bytes.Buffer
+	err = tpl.Execute(&buf, tplfields)
+	if err != nil {
+		return nil, err
+	}
+	if cliops.wsexplaintpl {
+		ExplainTemplate(tpl, tplfields)
+	}
+	return buf.Bytes(), nil
+}
+
+//
+// ExplainTemplate - print the fields referenced by the template (and its
+// associated templates), the referenced ones not provided and the provided
+// ones not referenced - only the top level names are compared
+func ExplainTemplate(tpl *template.Template, tplfields interface{}) {
+	refs := make(map[string]bool)
+	for _, t := range tpl.Templates() {
+		if t.Tree != nil {
+			TemplateFieldRefs(t.Tree.Root, refs)
+		}
+	}
+	provided := make(map[string]bool)
+	if m, ok := tplfields.(map[string]interface{}); ok {
+		for k := range m {
+			provided[k] = true
+		}
+	}
+	var used, missing, unused []string
+	for k := range refs {
+		used = append(used, k)
+		if !provided[strings.SplitN(k, ".", 2)[0]] {
+			missing = append(missing, k)
+		}
+	}
+	for k := range provided {
+		found := false
+		for r := range refs {
+			if r == k || strings.HasPrefix(r, k+".") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unused = append(unused, k)
+		}
+	}
+	sort.Strings(used)
+	sort.Strings(missing)
+	sort.Strings(unused)
+	PrintMsg("Template fields referenced (%d): %s\n", len(used), strings.Join(used, ", "))
+	PrintMsg("Template fields not provided (%d): %s\n", len(missing), strings.Join(missing, ", "))
+	PrintMsg("Provided fields not referenced (%d): %s\n", len(unused), strings.Join(unused, ", "))
+}
+
+//
+// TemplateFieldRefs - add to refs the paths of the fields referenced in the
+// template node tree (e.g., 'caller' for {{.caller}}, 'user.name' for
+// {{.user.name}} or {{$.user.name}}) - the fields inside range and with
+// blocks are relative to their value, but they are added as well
+func TemplateFieldRefs(node parse.Node, refs map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			TemplateFieldRefs(c, refs)
+		}
+	case *parse.ActionNode:
+		TemplateFieldRefs(n.Pipe, refs)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			TemplateFieldRefs(c, refs)
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			TemplateFieldRefs(a, refs)
+		}
+	case *parse.FieldNode:
+		refs[strings.Join(n.Ident, ".")] = true
+	case *parse.VariableNode:
+		if len(n.Ident) > 1 && n.Ident[0] == "$" {
+			refs[strings.Join(n.Ident[1:], ".")] = true
+		}
+	case *parse.ChainNode:
+		TemplateFieldRefs(n.Node, refs)
+	case *parse.IfNode:
+		TemplateFieldRefs(n.Pipe, refs)
+		TemplateFieldRefs(n.List, refs)
+		TemplateFieldRefs(n.ElseList, refs)
+	case *parse.RangeNode:
+		TemplateFieldRefs(n.Pipe, refs)
+		TemplateFieldRefs(n.List, refs)
+		TemplateFieldRefs(n.ElseList, refs)
+	case *parse.WithNode:
+		TemplateFieldRefs(n.Pipe, refs)
+		TemplateFieldRefs(n.List, refs)
+		TemplateFieldRefs(n.ElseList, refs)
+	case *parse.TemplateNode:
+		TemplateFieldRefs(n.Pipe, refs)
+	}
+}
+
+//
+// DecodeHex - return the bytes from a hex string, ignoring the whitespace
+// characters - the error gives the offset of the invalid character
+func DecodeHex(data []byte) ([]byte, error) {
+	var obuf bytes.Buffer
+	var hb byte
+	nd := 0
+	for i, c := range data {
+		var v byte
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			continue
+		case c >= '0' && c <= '9':
+			v = c - '0'
+		case c >= 'a' && c <= 'f':
+			v = c - 'a' + 10
+		case c >= 'A' && c <= 'F':
+			v = c - 'A' + 10
+		default:
+			return nil, fmt.Errorf("invalid hex character %q at offset %d", c, i)
+		}
+		if nd%2 == 0 {
+			hb = v << 4
+		} else {
+			obuf.WriteByte(hb | v)
+		}
+		nd++
+	}
+	if nd%2 != 0 {
+		return nil, fmt.Errorf("odd number of hex digits (%d)", nd)
+	}
+	return obuf.Bytes(), nil
+}
+
+//
+// ToCRLF - replace '\n' with '\r\n', leaving unchanged the line endings
+// that are already '\r\n'
+func ToCRLF(data []byte) []byte {
+	var buf bytes.Buffer
+	for i, c := range data {
+		if c == '\n' && (i == 0 || data[i-1] != '\r') {
+			buf.WriteByte('\r')
+		}
+		buf.WriteByte(c)
+	}
+	return buf.Bytes()
+}
+
+//
+// ToLF - replace '\r\n' with '\n', leaving unchanged the other '\r'
+// characters
+func ToLF(data []byte) []byte {
+	return bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+}
+
+//
+// NewTemplateFuncs - return the functions that can be used in the data
+// template - a new set has to be used for each connection
+func NewTemplateFuncs() template.FuncMap {
+	seqno := 0
+	return template.FuncMap{
+		// increasing number on each call: 1, 2, 3, ...
+		"seq": func() int {
+			seqno++
+			return seqno
+		},
+		// percent-encoding of a value (space encoded as %20), like for the
+		// user part of a sip uri
+		"urlquery": func(v string) string {
+			return strings.Replace(url.QueryEscape(v), "+", "%20", -1)
+		},
+		// decoding of a percent-encoded value ('+' is not changed)
+		"urlunescape": func(v string) (string, error) {
+			return url.PathUnescape(v)
+		},
+		"b64enc": func(v string) string {
+			return base64.StdEncoding.EncodeToString([]byte(v))
+		},
+		"b64dec": func(v string) (string, error) {
+			d, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return TemplateFuncError("b64dec", err)
+			}
+			return string(d), nil
+		},
+		// random element of a list (e.g., a json array from fields file)
+		"pick": func(v []interface{}) (interface{}, error) {
+			if len(v) == 0 {
+				return TemplateFuncError("pick", fmt.Errorf("empty list"))
+			}
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(v))))
+			if err != nil {
+				return nil, err
+			}
+			return v[n.Int64()], nil
+		},
+	}
+}
+
+//
+// TemplateFuncError - return the error of a template function if strict
+// template mode is set, otherwise print a warning and return empty value
+func TemplateFuncError(fname string, err error) (string, error) {
+	if cliops.wsstricttpl {
+		return "", err
+	}
+	PrintWarn("template function %s failed: %v - using empty value\n", fname, err)
+	return "", nil
+}
+
+//
+// SetTemplateField - return a copy of the fields data with the field name
+// set to val - the fields data must be a JSON object
+func SetTemplateField(tplfields interface{}, name string, val interface{}) (interface{}, error) {
+	fmap, ok := tplfields.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot set field '%s' - the fields data is not a JSON object", name)
+	}
+	nmap := make(map[string]interface{}, len(fmap)+1)
+	for k, v := range fmap {
+		nmap[k] = v
+	}
+	nmap[name] = val
+	return nmap, nil
+}
+
+//
+// ResolveSecret - return the value of a secret option - if it is prefixed
+// with 'env:' it is taken from the environment variable, if it is prefixed
+// with 'file:' it is read from the file (without the trailing newline)
+func ResolveSecret(val string) (string, error) {
+	if strings.HasPrefix(val, "env:") {
+		v, ok := os.LookupEnv(val[4:])
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", val[4:])
+		}
+		return v, nil
+	}
+	if strings.HasPrefix(val, "file:") {
+		fdata, err := ioutil.ReadFile(val[5:])
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(fdata), "\r\n"), nil
+	}
+	return val, nil
+}
+
+//
+// RenderOption - render the value of a command line option as a template
+// with the fields data - it is done in a single pass, the result is not
+// rendered again even if it contains template directives
+func RenderOption(oname string, oval string, tplfields interface{}) (string, error) {
+	if !strings.Contains(oval, tplDelimLeft) {
+		return oval, nil
+	}
+	tpl, err := template.New(oname).Delims(tplDelimLeft, tplDelimRight).Parse(oval)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the template of option '%s': %v", oname, err)
+	}
+	if cliops.wsstricttpl || cliops.wsreqfields {
+		tpl.Option("missingkey=error")
+	}
+	var buf bytes.Buffer
+	err = tpl.Execute(&buf, tplfields)
+	if err != nil {
+		return "", fmt.Errorf("failed to render the template of option '%s': %v", oname, err)
+	}
+	return buf.String(), nil
+}
+
+//
+// LoadProfile - set the command line options from the named profile of the
+// config file - the options given in command line are not changed
+func LoadProfile(cfgpath string, pname string) error {
+	if cfgpath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		cfgpath = filepath.Join(home, ".wsctl.json")
+	}
+	cfgdata, err := ioutil.ReadFile(cfgpath)
+	if err != nil {
+		return err
+	}
+	var cfg struct {
+		Profiles map[string]map[string]interface{} `json:"profiles"`
+	}
+	err = json.Unmarshal(cfgdata, &cfg)
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", cfgpath, err)
+	}
+	profile, ok := cfg.Profiles[pname]
+	if !ok {
+		return fmt.Errorf("profile '%s' not found in config file %s", pname, cfgpath)
+	}
+	// the long and short versions of an option share the value
+	cliset := map[flag.Value]bool{}
+	cliFlags.Visit(func(f *flag.Flag) {
+		cliset[f.Value] = true
+	})
+	for oname, oval := range profile {
+		f := flag.Lookup(oname)
+		if f == nil {
+			return fmt.Errorf("unknown option '%s' in profile '%s'", oname, pname)
+		}
+		if cliset[f.Value] {
+			continue
+		}
+		// a list of values for options that can be given many times
+		ovals, ok := oval.([]interface{})
+		if !ok {
+			ovals = []interface{}{oval}
+		}
+		for _, v := range ovals {
+			err = flag.Set(oname, fmt.Sprint(v))
+			if err != nil {
+				return fmt.Errorf("invalid value for option '%s' in profile '%s': %v", oname, pname, err)
+			}
+		}
+	}
+	return nil
+}
+
+//
+// PrintConfig - print the effective values of the options (after loading the
+// profile and resolving the secrets) as a json object, by their long names -
+// the passwords and credentials are redacted
+func PrintConfig() {
+	// the long and short versions of an option share the value
+	onames := map[flag.Value]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		if len(f.Name) > len(onames[f.Value]) {
+			onames[f.Value] = f.Name
+		}
+	})
+	opts := map[string]interface{}{}
+	for fv, oname := range onames {
+		var oval interface{}
+		switch v := fv.(type) {
+		case *StringListFlag:
+			oval = []string(*v)
+		case flag.Getter:
+			oval = v.Get()
+			if d, ok := oval.(time.Duration); ok {
+				oval = d.String()
+			}
+		default:
+			oval = fv.String()
+		}
+		switch oname {
+		case "apasswd", "proxy-auth":
+			if oval != "" {
+				oval = "REDACTED"
+			}
+		case "url":
+			// password in the userinfo of the urls
+			var urls []string
+			for _, u := range oval.([]string) {
+				if up, err := url.Parse(u); err == nil {
+					u = up.Redacted()
+				}
+				urls = append(urls, u)
+			}
+			oval = urls
+		}
+		opts[oname] = oval
+	}
+	data, err := json.MarshalIndent(opts, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(data))
+}
+
+//
+// ReadFieldsData - return the content of the fields file, decompressed
+// with gzip if the file has the '.gz' extension - if the path starts with
+// 'http://' or 'https://', the content is fetched from the url
+func ReadFieldsData(fpath string) ([]byte, error) {
+	var r io.Reader
+	fext := filepath.Ext(fpath)
+	if strings.HasPrefix(fpath, "http://") || strings.HasPrefix(fpath, "https://") {
+		client := &http.Client{
+			Timeout: time.Duration(cliops.wstimeoutrecv) * time.Millisecond,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: cliops.wsinsecure},
+			},
+		}
+		if cliops.wstimeoutrecv <= 0 {
+			client.Timeout = 0
+		}
+		resp, err := client.Get(fpath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch fields from %s: %v", fpath, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("failed to fetch fields from %s: %s", fpath, resp.Status)
+		}
+		if u, err := url.Parse(fpath); err == nil {
+			fext = path.Ext(u.Path)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(fpath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	if fext != ".gz" {
+		return ioutil.ReadAll(r)
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress fields file %s: %v", fpath, err)
+	}
+	defer zr.Close()
+	fdata, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress fields file %s: %v", fpath, err)
+	}
+	return fdata, nil
+}
+
+//
+// ReadBundle - return the data template, the name and the content of the
+// fields file (nil if missing) from the zip archive of a bundle - the files
+// are taken from the directory of the case if bcase is not empty
+func ReadBundle(bpath string, bcase string) ([]byte, string, []byte, error) {
+	zr, err := zip.OpenReader(bpath)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to open bundle %s: %v", bpath, err)
+	}
+	defer zr.Close()
+	prefix := ""
+	if bcase != "" {
+		prefix = strings.Trim(bcase, "/") + "/"
+	}
+	var tplf, fldf *zip.File
+	var cases []string
+	for _, f := range zr.File {
+		dir, base := path.Split(f.Name)
+		if dir == prefix && base == "template.tpl" {
+			tplf = f
+		} else if dir == prefix && strings.TrimSuffix(base, path.Ext(base)) == "fields" && fldf == nil {
+			fldf = f
+		} else if base == "template.tpl" && strings.Count(dir, "/") == 1 {
+			cases = append(cases, strings.TrimSuffix(dir, "/"))
+		}
+	}
+	if tplf == nil {
+		if bcase == "" && len(cases) > 0 {
+			return nil, "", nil, fmt.Errorf("bundle %s has no template.tpl at top level - select one of the cases with '--bundle-case': %s",
+				bpath, strings.Join(cases, ", "))
+		}
+		return nil, "", nil, fmt.Errorf("missing %stemplate.tpl in bundle %s", prefix, bpath)
+	}
+	tpldata, err := ReadZipFile(tplf)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to read %s from bundle %s: %v", tplf.Name, bpath, err)
+	}
+	if fldf == nil {
+		PrintMsg("Using bundle %s (template: %s, fields: none)\n", bpath, tplf.Name)
+		return tpldata, "", nil, nil
+	}
+	fdata, err := ReadZipFile(fldf)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to read %s from bundle %s: %v", fldf.Name, bpath, err)
+	}
+	PrintMsg("Using bundle %s (template: %s, fields: %s)\n", bpath, tplf.Name, fldf.Name)
+	return tpldata, fldf.Name, fdata, nil
+}
+
+//
+// ReadZipFile - return the uncompressed content of a file from a zip archive
+func ReadZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+//
+// ParseFieldsData - return the fields from the content of the fields file,
+// parsed as json, yaml (a subset) or key=value properties - the extension
+// of the file is tried first, then the format is detected by content
+func ParseFieldsData(fpath string, fdata []byte) (interface{}, error) {
+	fname := fpath
+	if u, err := url.Parse(fpath); err == nil && u.Scheme != "" {
+		fname = u.Path
+	}
+	fext := strings.ToLower(path.Ext(strings.TrimSuffix(fname, ".gz")))
+	var tplfields interface{}
+	switch fext {
+	case ".json":
+		if err := json.Unmarshal(fdata, &tplfields); err == nil {
+			return tplfields, nil
+		}
+	case ".yaml", ".yml":
+		if fields, err := ParseFieldsYAML(string(fdata)); err == nil {
+			return fields, nil
+		}
+	case ".properties", ".env":
+		if fields, err := ParseFieldsProperties(string(fdata)); err == nil {
+			return fields, nil
+		}
+	}
+	t := bytes.TrimSpace(fdata)
+	if len(t) > 0 && (t[0] == '{' || t[0] == '[') {
+		err := json.Unmarshal(fdata, &tplfields)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse fields file %s as json: %v", fpath, err)
+		}
+		return tplfields, nil
+	}
+	fields, yerr := ParseFieldsYAML(string(fdata))
+	if yerr == nil {
+		return fields, nil
+	}
+	fields, perr := ParseFieldsProperties(string(fdata))
+	if perr == nil {
+		return fields, nil
+	}
+	return nil, fmt.Errorf("failed to parse fields file %s - not json, yaml (%v) or key=value properties (%v)", fpath, yerr, perr)
+}
+
+//
+// ParseFieldsYAML - return the fields from a yaml document with a flat
+// mapping - the values can be scalars (kept as strings) or lists of scalars
+// (as '- item' lines or '[a, b]'); nested mappings are not supported
+func ParseFieldsYAML(ydata string) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	lkey := ""
+	for i, line := range strings.Split(ydata, "\n") {
+		line = strings.TrimRight(line, "\r")
+		t := strings.TrimSpace(line)
+		if t == "" || strings.HasPrefix(t, "#") || t == "---" {
+			continue
+		}
+		if t == "-" || strings.HasPrefix(t, "- ") {
+			if lkey == "" {
+				return nil, fmt.Errorf("line %d: list item without key", i+1)
+			}
+			l, _ := fields[lkey].([]interface{})
+			fields[lkey] = append(l, yamlScalar(strings.TrimSpace(t[1:])))
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, fmt.Errorf("line %d: nested mappings are not supported", i+1)
+		}
+		c := strings.Index(line, ":")
+		if c <= 0 || (c+1 < len(line) && line[c+1] != ' ' && line[c+1] != '\t') {
+			return nil, fmt.Errorf("line %d: expected 'key: value'", i+1)
+		}
+		key := yamlScalar(strings.TrimSpace(line[:c]))
+		val := strings.TrimSpace(line[c+1:])
+		lkey = ""
+		switch {
+		case val == "" || strings.HasPrefix(val, "#"):
+			// list items on next lines, if any
+			lkey = key
+			fields[key] = nil
+		case strings.HasPrefix(val, "[") && strings.HasSuffix(val, "]"):
+			l := []interface{}{}
+			if items := strings.TrimSpace(val[1 : len(val)-1]); items != "" {
+				for _, item := range strings.Split(items, ",") {
+					l = append(l, yamlScalar(strings.TrimSpace(item)))
+				}
+			}
+			fields[key] = l
+		default:
+			fields[key] = yamlScalar(val)
+		}
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no fields")
+	}
+	return fields, nil
+}
+
+//
+// yamlScalar - return the value of a yaml scalar, without the quotes or the
+// trailing comment
+func yamlScalar(v string) string {
+	if len(v) >= 2 && v[0] == '"' {
+		if uv, err := strconv.Unquote(v); err == nil {
+			return uv
+		}
+	}
+	if len(v) >= 2 && v[0] == '\'' && v[len(v)-1] == '\'' {
+		return strings.Replace(v[1:len(v)-1], "''", "'", -1)
+	}
+	if p := strings.Index(v, " #"); p >= 0 {
+		v = strings.TrimSpace(v[:p])
+	}
+	return v
+}
+
+//
+// ParseFieldsProperties - return the fields from 'key=value' lines, the
+// ones starting with '#' or '!' being comments
+func ParseFieldsProperties(pdata string) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	for i, line := range strings.Split(pdata, "\n") {
+		t := strings.TrimSpace(line)
+		if t == "" || t[0] == '#' || t[0] == '!' {
+			continue
+		}
+		p := strings.Index(t, "=")
+		if p <= 0 {
+			return nil, fmt.Errorf("line %d: expected 'key=value'", i+1)
+		}
+		fields[strings.TrimSpace(t[:p])] = strings.TrimSpace(t[p+1:])
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no fields")
+	}
+	return fields, nil
+}
+
+//
+// LogMsg - print formatted output if the level is not lower than the one
+// set by --log-level - in text format, info and debug messages go to stdout
+// (prefixed with the current time if timestamps are enabled), warn and error
+// to stderr; in json format, a record per message is printed
+func LogMsg(level int, format string, a ...interface{}) {
+	if level < logLevel {
+		return
+	}
+	msg := fmt.Sprintf(format, a...)
+	out := os.Stdout
+	if level >= logLevelWarn {
+		out = os.Stderr
+	}
+	if cliops.wslogformat == "json" {
+		if strings.TrimSpace(msg) == "" {
+			// only formatting of text output
+			return
+		}
+		jrec, _ := json.Marshal(struct {
+			Time  string `json:"time"`
+			Level string `json:"level"`
+			Msg   string `json:"msg"`
+		}{time.Now().Format(time.RFC3339Nano), logLevelNames[level], strings.TrimRight(msg, "\n")})
+		fmt.Fprintf(out, "%s\n", jrec)
+		return
+	}
+	switch level {
+	case logLevelDebug:
+		msg = "debug: " + msg
+	case logLevelWarn:
+		msg = "warning: " + msg
+	case logLevelError:
+		msg = "error: " + msg
+	}
+	if cliops.wstimestamps && level < logLevelWarn && strings.TrimSpace(msg) != "" {
+		fmt.Fprintf(out, "[%s] ", time.Now().Format(time.RFC3339Nano))
+	}
+	fmt.Fprint(out, msg)
+}
+
+//
+// PrintMsg - print formatted output at info level
+func PrintMsg(format string, a ...interface{}) {
+	LogMsg(logLevelInfo, format, a...)
+}
+
+//
+// PrintDebug - print formatted output at debug level
+func PrintDebug(format string, a ...interface{}) {
+	LogMsg(logLevelDebug, format, a...)
+}
+
+//
+// PrintWarn - print formatted output at warn level
+func PrintWarn(format string, a ...interface{}) {
+	LogMsg(logLevelWarn, format, a...)
+}
+
+//
+// jsonLogWriter - output for log package in json format, the messages being
+// printed as error records
+type jsonLogWriter struct{}
+
+//
+// Write - print the message of the log package as an error record
+func (w jsonLogWriter) Write(p []byte) (int, error) {
+	LogMsg(logLevelError, "%s", p)
+	return len(p), nil
+}
+
+//
+// DisplayData - return the data to be printed for sent or received messages,
+// escaped to ascii or with ansi colors for sip messages if enabled
+func DisplayData(d []byte) []byte {
+	if cliops.wsascii {
+		return EscapeNonASCII(d)
+	}
+	if colorOutput && cliops.wsproto == "sip" {
+		return ColorSIPMsg(d)
+	}
+	return d
+}
+
+//
+// PrintRecvData - print the head line and the received data - with format
+// sip-json, a SIP message is printed as a JSON object on one line, otherwise
+// the data is printed between '[[' and ']]'
+func PrintRecvData(head string, rmsg []byte) {
+	if cliops.wsformat == "sip-json" && (isSIPResponse(rmsg) || SIPRequestMethod(rmsg) != "") {
+		var jbuf bytes.Buffer
+		jenc := json.NewEncoder(&jbuf)
+		// the sip uris kept readable, without escaping of '<', '>' and '&'
+		jenc.SetEscapeHTML(false)
+		err := jenc.Encode(ParseSIPMessage(rmsg))
+		if err == nil {
+			PrintMsg("%s\n%s", head, jbuf.Bytes())
+			return
+		}
+		PrintWarn("failed to encode the sip message in json: %v\n", err)
+	}
+	PrintMsg("%s\n[[%s]]\n", head, DisplayRecvData(rmsg))
+}
+
+//
+// SIPMessageJSON - structure of a SIP message printed with format sip-json:
+// the header values are also grouped by the long header name, each one
+// with an array of values (for repeated headers)
+type SIPMessageJSON struct {
+	Type         string              `json:"type"`
+	StartLine    string              `json:"start-line"`
+	Method       string              `json:"method,omitempty"`
+	URI          string              `json:"uri,omitempty"`
+	Status       int                 `json:"status,omitempty"`
+	Reason       string              `json:"reason,omitempty"`
+	Headers      []SIPHeaderJSON     `json:"headers"`
+	HeaderValues map[string][]string `json:"header-values"`
+	Body         string              `json:"body"`
+}
+
+//
+// SIPHeaderJSON - header of a SIP message printed with format sip-json, with
+// the name as in the message
+type SIPHeaderJSON struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+//
+// ParseSIPMessage - return the structure of the SIP message, with the
+// continuation lines of the headers joined
+func ParseSIPMessage(msg []byte) SIPMessageJSON {
+	umsg := unfoldHeaders(msg)
+	jmsg := SIPMessageJSON{Headers: []SIPHeaderJSON{}, HeaderValues: map[string][]string{}}
+	hdrs := string(umsg)
+	if b := SIPBody(umsg); b != nil {
+		jmsg.Body = string(b)
+		hdrs = string(umsg[:len(umsg)-len(b)])
+	}
+	for i, line := range strings.Split(hdrs, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if i == 0 {
+			jmsg.StartLine = line
+			f := strings.SplitN(line, " ", 3)
+			if isSIPResponse(umsg) {
+				jmsg.Type = "response"
+				jmsg.Status = SIPStatusCode(umsg)
+				if len(f) == 3 {
+					jmsg.Reason = f[2]
+				}
+			} else {
+				jmsg.Type = "request"
+				jmsg.Method = f[0]
+				if len(f) > 1 {
+					jmsg.URI = f[1]
+				}
+			}
+			continue
+		}
+		c := strings.IndexByte(line, ':')
+		if c <= 0 {
+			continue
+		}
+		name := strings.TrimSpace(line[:c])
+		value := strings.TrimSpace(line[c+1:])
+		jmsg.Headers = append(jmsg.Headers, SIPHeaderJSON{Name: name, Value: value})
+		lname := name
+		if ln, ok := sipCompactHeaders[strings.ToLower(name)]; ok {
+			lname = ln
+		}
+		for k := range jmsg.HeaderValues {
+			// same key for the names differing only by case
+			if strings.EqualFold(k, lname) {
+				lname = k
+				break
+			}
+		}
+		jmsg.HeaderValues[lname] = append(jmsg.HeaderValues[lname], value)
+	}
+	return jmsg
+}
+
+//
+// DisplayRecvData - return the received data prepared for printing, only
+// its first line if the status-only option is set
+func DisplayRecvData(d []byte) []byte {
+	if cliops.wsstatusonly {
+		if i := bytes.IndexByte(d, '\n'); i >= 0 {
+			d = bytes.TrimRight(d[:i], "\r")
+		}
+	}
+	return DisplayData(d)
+}
+
+//
+// EscapeNonASCII - return a copy of the data with the non-printable and
+// non-ascii bytes replaced by '\xNN' - the line breaks and tabs are kept
+func EscapeNonASCII(d []byte) []byte {
+	var obuf bytes.Buffer
+	for _, c := range d {
+		if (c >= 0x20 && c < 0x7f) || c == '\n' || c == '\r' || c == '\t' {
+			obuf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&obuf, "\\x%02x", c)
+		}
+	}
+	return obuf.Bytes()
+}
+
+//
+// ColorSIPMsg - return a copy of the SIP message with ansi colors: start
+// line in bold (red for 4xx, 5xx and 6xx responses), header names and values
+// in different colors - the body is not changed
+func ColorSIPMsg(msg []byte) []byte {
+	var obuf bytes.Buffer
+	lines := bytes.SplitAfter(msg, []byte("\n"))
+	for i, line := range lines {
+		text := bytes.TrimRight(line, "\r\n")
+		eol := line[len(text):]
+		if i == 0 {
+			if SIPStatusCode(msg) >= 400 {
+				obuf.WriteString(ansiRed)
+			} else {
+				obuf.WriteString(ansiBold)
+			}
+			obuf.Write(text)
+			obuf.WriteString(ansiReset)
+			obuf.Write(eol)
+			continue
+		}
+		if len(text) == 0 {
+			// end of headers - write the rest as it is
+			obuf.Write(bytes.Join(lines[i:], nil))
+			break
+		}
+		c := bytes.IndexByte(text, ':')
+		if c < 0 || text[0] == ' ' || text[0] == '\t' {
+			obuf.Write(line)
+			continue
+		}
+		obuf.WriteString(ansiCyan)
+		obuf.Write(text[:c])
+		obuf.WriteString(ansiReset)
+		obuf.WriteByte(':')
+		obuf.WriteString(ansiYellow)
+		obuf.Write(text[c+1:])
+		obuf.WriteString(ansiReset)
+		obuf.Write(eol)
+	}
+	return obuf.Bytes()
+}
+
+//
+// PrintRequest - print the sent data as a quoted string with escaped
+// control characters, if enabled by command line option
+func PrintRequest(wmsg []byte) {
+	if !cliops.wsprintreq {
+		return
+	}
+	PrintMsg("Sent data (%d bytes, escaped):\n%s\n", len(wmsg), strconv.Quote(string(wmsg)))
+}
+
+//
+// ParseAuthHeader - parse www/proxy-authenticate header body.
+// Return a map of parameters or nil if the header is not Digest auth header.
+func ParseAuthHeader(hbody []byte) map[string]string {
+	s := strings.SplitN(strings.Trim(string(hbody), " "), " ", 2)
+	if len(s) != 2 || s[0] != "Digest" {
+		return nil
+	}
+
+	params := map[string]string{}
+	for _, kv := range strings.Split(s[1], ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		params[strings.Trim(parts[0], "\" ")] = strings.Trim(parts[1], "\" ")
+	}
+	return params
+}
+
+//
+// ChooseAuthChallenge - return the params of the digest challenge with the
+// most preferred algorithm (no algorithm being MD5) - the challenges with
+// algorithms not in the preference list are used only if there is no other
+// one; return nil if there is no digest challenge
+func ChooseAuthChallenge(hvals []string) map[string]string {
+	var hparams map[string]string
+	nchal := 0
+	rank := len(authPreference)
+	for _, hval := range hvals {
+		cparams := ParseAuthHeader([]byte(hval))
+		if cparams == nil {
+			continue
+		}
+		nchal++
+		algorithm := strings.ToUpper(cparams["algorithm"])
+		if algorithm == "" {
+			algorithm = "MD5"
+		}
+		crank := len(authPreference)
+		for i, a := range authPreference {
+			if a == algorithm {
+				crank = i
+				break
+			}
+		}
+		if hparams == nil || crank < rank {
+			hparams = cparams
+			rank = crank
+		}
+	}
+	if nchal > 1 {
+		algorithm := hparams["algorithm"]
+		if algorithm == "" {
+			algorithm = "MD5"
+		}
+		PrintMsg("Auth challenges offered: %d - using the one with algorithm %s\n", nchal, algorithm)
+	}
+	return hparams
+}
+
+//
+// BuildAuthResponseHeader - return the body for auth header in response
+func BuildAuthResponseHeader(username string, password string, hparams map[string]string) string {
+	// https://en.wikipedia.org/wiki/Digest_access_authentication
+	algorithm := hparams["algorithm"]
+	halgorithm := algorithm
+	sess := strings.HasSuffix(strings.ToUpper(algorithm), "-SESS")
+	if sess {
+		halgorithm = algorithm[:len(algorithm)-5]
+	}
+	if _, ok := digestHashes[strings.ToUpper(halgorithm)]; !ok {
+		algorithm = "MD5"
+		halgorithm = "MD5"
+		sess = false
+	}
+	cnonce := RandomKey()
+	// HA1
+	HA1 := DigestHA1(halgorithm, sess, username, hparams["realm"], password, hparams["nonce"], cnonce)
+
+	// HA2
+	HA2 := HDigest(halgorithm, fmt.Sprintf("%s:%s", hparams["method"], hparams["uri"]))
+
+	// RFC 7616 - username sent hashed, H(username:realm) - the userhash in
+	// the example of section 3.9.2 is wrong, see erratum 4897
+	xparams := ""
+	if strings.ToLower(hparams["userhash"]) == "true" {
+		username = HDigest(halgorithm, fmt.Sprintf("%s:%s", username, hparams["realm"]))
+		xparams = ", userhash=true"
+	}
+
+	AuthHeader := ""
+	if _, ok := hparams["qop"]; !ok {
+		// build digest response
+		response := HDigest(halgorithm, strings.Join([]string{HA1, hparams["nonce"], HA2}, ":"))
+		// build header body - cnonce needed by the session variant
+		if sess {
+			xparams = fmt.Sprintf(`, cnonce="%s"`, cnonce) + xparams
+		}
+		AuthHeader = fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=%s, response="%s"%s`,
+			username, hparams["realm"], hparams["nonce"], hparams["uri"], algorithm, response, xparams)
+	} else {
+		// build digest response
+		response := HDigest(halgorithm, strings.Join([]string{HA1, hparams["nonce"], "00000001", cnonce, hparams["qop"], HA2}, ":"))
+		// build header body
+		AuthHeader = fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", cnonce="%s", nc=00000001, qop=%s, opaque="%s", algorithm=%s, response="%s"%s`,
+			username, hparams["realm"], hparams["nonce"], hparams["uri"], cnonce, hparams["qop"], hparams["opaque"], algorithm, response, xparams)
+	}
+	return AuthHeader
+}
+
+//
+// DigestHA1 - return the HA1 value of the digest response with the hash
+// algorithm, H(username:realm:password) - for the session variant it is
+// H(H(username:realm:password):nonce:cnonce)
+func DigestHA1(algorithm string, sess bool, username string, realm string, password string, nonce string, cnonce string) string {
+	HA1 := HDigest(algorithm, fmt.Sprintf("%s:%s:%s", username, realm, password))
+	if sess {
+		// session variant - nonce and cnonce in HA1
+		HA1 = HDigest(algorithm, strings.Join([]string{HA1, nonce, cnonce}, ":"))
+	}
+	return HA1
+}
+
+//
+// RandomKey - return random key (used for cnonce)
+func RandomKey() string {
+	key := make([]byte, 12)
+	for b := 0; b < len(key); {
+		n, err := rand.Read(key[b:])
+		if err != nil {
+			panic("failed to get random bytes")
+		}
+		b += n
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+//
+// NewUUID - return a random (version 4) uuid
+func NewUUID() string {
+	u := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, u); err != nil {
+		panic("failed to get random bytes")
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+//
+// HMD5 - return a lower-case hex MD5 digest of the parameter
+func HMD5(data string) string {
+	md5d := md5.New()
+	md5d.Write([]byte(data))
+	return fmt.Sprintf("%x", md5d.Sum(nil))
+}
+
+//
+// HDigest - return a lower-case hex digest of the parameter, computed with
+// the hash function of the digest auth algorithm (MD5 if not supported)
+func HDigest(algorithm string, data string) string {
+	hnew, ok := digestHashes[strings.ToUpper(algorithm)]
+	if !ok {
+		return HMD5(data)
+	}
+	h := hnew()
+	h.Write([]byte(data))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+//
+// isSIPResponse - return true if the data starts with a SIP status line,
+// i.e., 'SIP/2.0 ' followed by a three digits status code
+func isSIPResponse(msg []byte) bool {
+	if len(msg) < 11 || !bytes.HasPrefix(msg, []byte("SIP/2.0 ")) {
+		return false
+	}
+	for _, c := range msg[8:11] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return len(msg) == 11 || bytes.IndexByte([]byte(" \r\n"), msg[11]) >= 0
+}
+
+//
+// SIPStatusCode - return the status code of a SIP response or 0 if the data
+// is not a SIP response
+func SIPStatusCode(msg []byte) int {
+	if !isSIPResponse(msg) {
+		return 0
+	}
+	code, _ := strconv.Atoi(string(msg[8:11]))
+	return code
+}
+
+//
+// unfoldHeaders - join the continuation lines (starting with space or tab)
+// of the headers to the previous line, separated by a space - the body is
+// not changed
+func unfoldHeaders(msg []byte) []byte {
+	var buf bytes.Buffer
+	p := 0
+	for p < len(msg) {
+		e := bytes.IndexByte(msg[p:], '\n')
+		if e < 0 {
+			buf.Write(msg[p:])
+			break
+		}
+		line := msg[p : p+e+1]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// end of headers
+			buf.Write(msg[p:])
+			break
+		}
+		if p > 0 && (line[0] == ' ' || line[0] == '\t') {
+			// drop the line terminator of the previous line
+			b := bytes.TrimRight(buf.Bytes(), "\r\n")
+			buf.Truncate(len(b))
+			buf.WriteByte(' ')
+			line = bytes.TrimLeft(line, " \t")
+		}
+		buf.Write(line)
+		p += e + 1
+	}
+	return buf.Bytes()
+}
+
+//
+// SIPHeaderBounds - return the start and end offsets of the first header with
+// the name hname (case insensitive, long or compact form) - the end offset
+// excludes the line terminator; return -1, -1 if the header is not found
+func SIPHeaderBounds(msg []byte, hname string) (int, int) {
+	cname := ""
+	for k, v := range sipCompactHeaders {
+		if strings.EqualFold(v, hname) {
+			cname = k
+			break
+		}
+	}
+	// skip the first line
+	p := bytes.IndexByte(msg, '\n')
+	for p >= 0 && p+1 < len(msg) {
+		s := p + 1
+		e := bytes.IndexByte(msg[s:], '\n')
+		if e < 0 {
+			e = len(msg)
+		} else {
+			e += s
+		}
+		line := bytes.TrimRight(msg[s:e], "\r")
+		if len(line) == 0 {
+			// end of headers
+			break
+		}
+		c := bytes.IndexByte(line, ':')
+		if c > 0 {
+			name := strings.TrimSpace(string(line[:c]))
+			if strings.EqualFold(name, hname) || (cname != "" && strings.EqualFold(name, cname)) {
+				return s, s + len(line)
+			}
+		}
+		p = e
+		if p == len(msg) {
+			break
+		}
+	}
+	return -1, -1
+}
+
+//
+// SIPHeaderValues - return the values of all the headers with the name hname
+// (case insensitive, long or compact form), in the order of the message
+func SIPHeaderValues(msg []byte, hname string) []string {
+	var vals []string
+	for {
+		s, e := SIPHeaderBounds(msg, hname)
+		if s < 0 {
+			return vals
+		}
+		vals = append(vals, strings.TrimSpace(string(msg[s+bytes.IndexByte(msg[s:e], ':')+1:e])))
+		// the rest of the message, keeping a first line to be skipped
+		msg = msg[e-1:]
+	}
+}
+
+//
+// SIPReplaceRange - return a copy of msg with the bytes from s to e replaced
+func SIPReplaceRange(msg []byte, s int, e int, val []byte) []byte {
+	var obuf bytes.Buffer
+	obuf.Write(msg[:s])
+	obuf.Write(val)
+	obuf.Write(msg[e:])
+	return obuf.Bytes()
+}
+
+//
+// SIPIncCSeq - return a copy of the SIP message with CSeq number increased
+func SIPIncCSeq(msg []byte) []byte {
+	s, e := SIPHeaderBounds(msg, "CSeq")
+	if s < 0 {
+		return msg
+	}
+	hbody := strings.TrimSpace(string(msg[s+bytes.IndexByte(msg[s:e], ':')+1 : e]))
+	p := strings.SplitN(hbody, " ", 2)
+	if len(p) != 2 {
+		return msg
+	}
+	csn, err := strconv.Atoi(p[0])
+	if err != nil {
+		return msg
+	}
+	return SIPReplaceRange(msg, s, e, []byte("CSeq: "+strconv.Itoa(1+csn)+" "+strings.TrimSpace(p[1])))
+}
+
+//
+// SIPCSeqNumber - return the number in the CSeq header or 0 if not found
+func SIPCSeqNumber(msg []byte) int {
+	s, e := SIPHeaderBounds(msg, "CSeq")
+	if s < 0 {
+		return 0
+	}
+	p := strings.Fields(string(msg[s+bytes.IndexByte(msg[s:e], ':')+1 : e]))
+	if len(p) == 0 {
+		return 0
+	}
+	csn, _ := strconv.Atoi(p[0])
+	return csn
+}
+
+//
+// SIPSetCSeqNumber - return a copy of the SIP message with the number in
+// the CSeq header set to csn
+func SIPSetCSeqNumber(msg []byte, csn int) []byte {
+	s, e := SIPHeaderBounds(msg, "CSeq")
+	if s < 0 {
+		return msg
+	}
+	p := strings.Fields(string(msg[s+bytes.IndexByte(msg[s:e], ':')+1 : e]))
+	if len(p) != 2 {
+		return msg
+	}
+	return SIPReplaceRange(msg, s, e, []byte("CSeq: "+strconv.Itoa(csn)+" "+p[1]))
+}
+
+//
+// SIPExpires - return the expires value granted in a SIP response: the
+// expires parameter of the first Contact header or, if missing, the value
+// of the Expires header; -1 if none is found
+func SIPExpires(msg []byte) int {
+	msg = unfoldHeaders(msg)
+	if _, ue := SIPContactBounds(msg); ue >= 0 {
+		_, e := SIPHeaderBounds(msg, "Contact")
+		hprms := string(msg[ue:e])
+		if p := strings.Index(hprms, ">"); p >= 0 {
+			hprms = hprms[p+1:]
+		}
+		// only the first contact if many are in the same header
+		if p := strings.Index(hprms, ","); p >= 0 {
+			hprms = hprms[:p]
+		}
+		for _, prm := range strings.Split(hprms, ";") {
+			kv := strings.SplitN(strings.TrimSpace(prm), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "expires") {
+				if v, err := strconv.Atoi(strings.TrimSpace(kv[1])); err == nil {
+					return v
+				}
+			}
+		}
+	}
+	s, e := SIPHeaderBounds(msg, "Expires")
+	if s < 0 {
+		return -1
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(msg[s+bytes.IndexByte(msg[s:e], ':')+1 : e])))
+	if err != nil {
+		return -1
+	}
+	return v
+}
+
+//
+// SIPNewViaBranch - return a copy of the SIP message with a new branch
+// parameter in the top Via header
+func SIPNewViaBranch(msg []byte) []byte {
+	s, e := SIPHeaderBounds(msg, "Via")
+	if s < 0 {
+		return msg
+	}
+	b := bytes.Index(msg[s:e], []byte(";branch="))
+	if b < 0 {
+		return msg
+	}
+	b += s + len(";branch=")
+	be := b
+	for be < e && bytes.IndexByte([]byte(" \t;,"), msg[be]) < 0 {
+		be++
+	}
+	return SIPReplaceRange(msg, b, be, []byte("z9hG4bK"+HMD5(RandomKey())[:16]))
+}
+
+//
+// SIPAttachBody - return the SIP message with the body added after the
+// headers and the Content-Length header set to its size - error if the
+// message has already a body
+func SIPAttachBody(msg []byte, body []byte) ([]byte, error) {
+	eol := "\n"
+	if bytes.Contains(msg, []byte("\r\n")) {
+		eol = "\r\n"
+	}
+	hdrs := msg
+	if p := bytes.Index(msg, []byte("\n\r\n")); p >= 0 {
+		hdrs = msg[:p+1]
+	} else if p := bytes.Index(msg, []byte("\n\n")); p >= 0 {
+		hdrs = msg[:p+1]
+	}
+	if len(bytes.TrimSpace(msg[len(hdrs):])) > 0 {
+		return nil, fmt.Errorf("the sip message has already a body - cannot add the one from body file")
+	}
+	hdrs = bytes.TrimRight(hdrs, "\r\n")
+	clen := "Content-Length: " + strconv.Itoa(len(body))
+	if s, e := SIPHeaderBounds(hdrs, "Content-Length"); s >= 0 {
+		hdrs = SIPReplaceRange(hdrs, s, e, []byte(clen))
+	} else {
+		hdrs = append(append([]byte{}, hdrs...), []byte(eol+clen)...)
+	}
+	var obuf bytes.Buffer
+	obuf.Write(hdrs)
+	obuf.WriteString(eol + eol)
+	obuf.Write(body)
+	return obuf.Bytes(), nil
+}
+
+//
+// SIPBody - return the body of the SIP message (after the empty line), nil
+// if it has none
+func SIPBody(msg []byte) []byte {
+	if p := bytes.Index(msg, []byte("\r\n\r\n")); p >= 0 {
+		return msg[p+4:]
+	} else if p := bytes.Index(msg, []byte("\n\n")); p >= 0 {
+		return msg[p+2:]
+	}
+	return nil
+}
+
+//
+// SDPSummary - return a line for each media stream of the SDP with the
+// remote endpoint (from the session or media 'c=' line and the 'm=' line)
+// and the codec (first payload type of the 'm=' line, named by 'a=rtpmap')
+// - empty if the body is not SDP
+func SDPSummary(body []byte) []string {
+	if !bytes.HasPrefix(bytes.TrimLeft(body, " \t\r\n"), []byte("v=0")) {
+		return nil
+	}
+	type sdpMedia struct {
+		media, port, proto, addr, pt string
+		rtpmap                       map[string]string
+	}
+	var medias []*sdpMedia
+	saddr := ""
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) < 2 || line[1] != '=' {
+			continue
+		}
+		val := line[2:]
+		f := strings.Fields(val)
+		switch line[0] {
+		case 'c':
+			// c=IN IP4 10.0.0.1
+			if len(f) < 3 {
+				continue
+			}
+			if len(medias) == 0 {
+				saddr = f[2]
+			} else {
+				medias[len(medias)-1].addr = f[2]
+			}
+		case 'm':
+			// m=audio 4000 RTP/AVP 0 8 101
+			if len(f) < 3 {
+				continue
+			}
+			m := &sdpMedia{media: f[0], port: f[1], proto: f[2], rtpmap: map[string]string{}}
+			if len(f) > 3 {
+				m.pt = f[3]
+			}
+			medias = append(medias, m)
+		case 'a':
+			// a=rtpmap:0 PCMU/8000
+			if len(medias) > 0 && strings.HasPrefix(val, "rtpmap:") && len(f) > 1 {
+				medias[len(medias)-1].rtpmap[strings.TrimPrefix(f[0], "rtpmap:")] = f[1]
+			}
+		}
+	}
+	// static payload types of RFC 3551, used when there is no rtpmap
+	staticpt := map[string]string{"0": "PCMU/8000", "3": "GSM/8000", "4": "G723/8000", "8": "PCMA/8000", "9": "G722/8000", "18": "G729/8000"}
+	var lines []string
+	for _, m := range medias {
+		addr := m.addr
+		if addr == "" {
+			addr = saddr
+		}
+		if m.port == "0" {
+			lines = append(lines, fmt.Sprintf("SDP media %s: rejected (port 0)", m.media))
+			continue
+		}
+		codec := m.rtpmap[m.pt]
+		if codec == "" {
+			codec = staticpt[m.pt]
+		}
+		if codec == "" {
+			codec = "unknown"
+		}
+		lines = append(lines, fmt.Sprintf("SDP media %s: remote endpoint %s (%s) - codec %s (payload type %s)",
+			m.media, net.JoinHostPort(addr, m.port), m.proto, codec, m.pt))
+	}
+	return lines
+}
+
+//
+// SIPAddHeader - return a copy of the SIP message with the header added
+// after the start line, using the same line terminator
+func SIPAddHeader(msg []byte, hdr string) []byte {
+	e := bytes.IndexByte(msg, '\n')
+	if e < 0 {
+		return msg
+	}
+	eol := "\n"
+	if e > 0 && msg[e-1] == '\r' {
+		eol = "\r\n"
+	}
+	return SIPReplaceRange(msg, e+1, e+1, []byte(hdr+eol))
+}
+
+//
+// SIPAuthInsertPos - return the offset where to insert the auth header in
+// the request - after the CSeq header, but not between the Route or
+// Record-Route headers following it, to keep them contiguous; -1 if the
+// CSeq header is not found
+func SIPAuthInsertPos(msg []byte) int {
+	_, e := SIPHeaderBounds(msg, "CSeq")
+	if e < 0 {
+		return -1
+	}
+	for {
+		p := bytes.IndexByte(msg[e:], '\n')
+		if p < 0 {
+			return e
+		}
+		s := e + p + 1
+		le := bytes.IndexByte(msg[s:], '\n')
+		if le < 0 {
+			le = len(msg)
+		} else {
+			le += s
+		}
+		line := bytes.TrimRight(msg[s:le], "\r")
+		if len(line) == 0 {
+			// end of headers
+			return e
+		}
+		// continuation lines belong to the previous header
+		if line[0] != ' ' && line[0] != '\t' {
+			c := bytes.IndexByte(line, ':')
+			if c <= 0 {
+				return e
+			}
+			hname := strings.ToLower(strings.TrimSpace(string(line[:c])))
+			if hname != "route" && hname != "record-route" {
+				return e
+			}
+		}
+		e = s + len(line)
+	}
+}
+
+//
+// SIPCheckMessage - return the problems of the SIP message: invalid start
+// line, missing mandatory headers or CSeq method different than the one of
+// the request line - empty if none
+func SIPCheckMessage(msg []byte) []string {
+	var problems []string
+	isrpl := isSIPResponse(msg)
+	method := SIPRequestMethod(msg)
+	if !isrpl {
+		if method == "" {
+			e := bytes.IndexByte(msg, '\n')
+			if e < 0 {
+				e = len(msg)
+			}
+			problems = append(problems, fmt.Sprintf("invalid start line: %q", bytes.TrimRight(msg[:e], "\r")))
+		} else if e := bytes.IndexByte(msg, '\n'); e < 0 || !bytes.HasSuffix(bytes.TrimRight(msg[:e], "\r"), []byte(" SIP/2.0")) {
+			problems = append(problems, "unsupported sip version in request line (must be SIP/2.0)")
+		}
+	}
+	for _, hname := range sipMandatoryHeaders {
+		if isrpl && hname == "Max-Forwards" {
+			continue
+		}
+		if s, _ := SIPHeaderBounds(msg, hname); s < 0 {
+			problems = append(problems, "missing header: "+hname)
+		}
+	}
+	if s, e := SIPHeaderBounds(msg, "CSeq"); s >= 0 {
+		p := strings.Fields(string(msg[s+bytes.IndexByte(msg[s:e], ':')+1 : e]))
+		if len(p) != 2 {
+			problems = append(problems, "invalid CSeq header (must be number and method)")
+		} else if _, err := strconv.Atoi(p[0]); err != nil {
+			problems = append(problems, "invalid CSeq number: "+p[0])
+		} else if method != "" && p[1] != method {
+			problems = append(problems, fmt.Sprintf("CSeq method %s does not match the request method %s", p[1], method))
+		}
+	}
+	return problems
+}
+
+//
+// SIPRequestMethod - return the method of a SIP request or empty string if
+// the data is not a SIP request
+func SIPRequestMethod(msg []byte) string {
+	e := bytes.IndexByte(msg, '\n')
+	if e < 0 {
+		e = len(msg)
+	}
+	s := strings.Fields(string(msg[:e]))
+	if len(s) != 3 || !strings.HasPrefix(s[2], "SIP/") {
+		return ""
+	}
+	return s[0]
+}
+
+//
+// SIPBuildResponse - return a minimal SIP response to the request, with the
+// Via, From, To, Call-ID and CSeq headers copied from it (a tag is added to
+// the To header if it has none)
+func SIPBuildResponse(req []byte, status string) []byte {
+	var obuf bytes.Buffer
+	obuf.WriteString("SIP/2.0 " + status + "\r\n")
+	msg := unfoldHeaders(req)
+	p := bytes.IndexByte(msg, '\n')
+	for p >= 0 && p+1 < len(msg) {
+		s := p + 1
+		e := bytes.IndexByte(msg[s:], '\n')
+		if e < 0 {
+			e = len(msg)
+		} else {
+			e += s
+		}
+		line := bytes.TrimRight(msg[s:e], "\r")
+		if len(line) == 0 {
+			// end of headers
+			break
+		}
+		c := bytes.IndexByte(line, ':')
+		if c > 0 {
+			hname := strings.TrimSpace(string(line[:c]))
+			if fname, ok := sipCompactHeaders[strings.ToLower(hname)]; ok {
+				hname = fname
+			}
+			switch strings.ToLower(hname) {
+			case "via", "from", "call-id", "cseq":
+				obuf.WriteString(hname + ": " + strings.TrimSpace(string(line[c+1:])) + "\r\n")
+			case "to":
+				hbody := strings.TrimSpace(string(line[c+1:]))
+				if !strings.Contains(strings.ToLower(hbody), ";tag=") {
+					hbody += ";tag=" + HMD5(RandomKey())[:16]
+				}
+				obuf.WriteString(hname + ": " + hbody + "\r\n")
+			}
+		}
+		p = e
+		if p == len(msg) {
+			break
+		}
+	}
+	obuf.WriteString("Content-Length: 0\r\n\r\n")
+	return obuf.Bytes()
+}
+
+//
+// SIPViaNATParams - return the values of the received and rport parameters
+// from the top Via header, with "none" for the missing ones
+func SIPViaNATParams(msg []byte) (string, string) {
+	vrecv, vrport := "none", "none"
+	s, e := SIPHeaderBounds(msg, "Via")
+	if s < 0 {
+		return vrecv, vrport
+	}
+	hval := string(msg[s+bytes.IndexByte(msg[s:e], ':')+1 : e])
+	// only the first via body if many are in the same header
+	if p := strings.Index(hval, ","); p >= 0 {
+		hval = hval[:p]
+	}
+	for _, prm := range strings.Split(hval, ";")[1:] {
+		kv := strings.SplitN(strings.TrimSpace(prm), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch strings.ToLower(kv[0]) {
+		case "received":
+			vrecv = kv[1]
+		case "rport":
+			vrport = kv[1]
+		}
+	}
+	return vrecv, vrport
+}
+
+//
+// SIPContactBounds - return the start and end offsets of the URI in the
+// first Contact header or -1, -1 if not found
+func SIPContactBounds(msg []byte) (int, int) {
+	s, e := SIPHeaderBounds(msg, "Contact")
+	if s < 0 {
+		return -1, -1
+	}
+	us := s + bytes.IndexByte(msg[s:e], ':') + 1
+	ue := e
+	if p := bytes.IndexByte(msg[us:e], '<'); p >= 0 {
+		us += p + 1
+		if p = bytes.IndexByte(msg[us:e], '>'); p < 0 {
+			return -1, -1
+		}
+		ue = us + p
+	} else {
+		for us < e && (msg[us] == ' ' || msg[us] == '\t') {
+			us++
+		}
+		if p = bytes.IndexByte(msg[us:e], ';'); p >= 0 {
+			ue = us + p
+		}
+	}
+	return us, ue
+}
+
+//
+// SIPURIHostBounds - return the start and end offsets of the host and port
+// part of the SIP URI or -1, -1 if the URI has no scheme
+func SIPURIHostBounds(uri string) (int, int) {
+	p := strings.Index(uri, ":")
+	if p < 0 {
+		return -1, -1
+	}
+	hs := p + 1
+	if a := strings.Index(uri[hs:], "@"); a >= 0 {
+		hs += a + 1
+	}
+	he := hs
+	for he < len(uri) && uri[he] != ';' && uri[he] != '?' {
+		he++
+	}
+	return hs, he
+}
+
+//
+// SIPSetRURIHost - return a copy of the SIP request with the host and port of
+// the Request-URI replaced by host
+func SIPSetRURIHost(msg []byte, host string) []byte {
+	p := bytes.SplitN(msg, []byte(" "), 3)
+	if len(p) != 3 {
+		return msg
+	}
+	uri := string(p[1])
+	hs, he := SIPURIHostBounds(uri)
+	if hs < 0 {
+		return msg
+	}
+	return SIPSetRURI(msg, uri[:hs]+host+uri[he:])
+}
+
+//
+// SIPSetMethod - return a copy of the SIP request with the method replaced in
+// the request line and in the CSeq header
+func SIPSetMethod(msg []byte, method string) []byte {
+	p := bytes.IndexByte(msg, ' ')
+	if p <= 0 {
+		return msg
+	}
+	msg = SIPReplaceRange(msg, 0, p, []byte(method))
+	s, e := SIPHeaderBounds(msg, "CSeq")
+	if s < 0 {
+		return msg
+	}
+	hbody := strings.Fields(string(msg[s+bytes.IndexByte(msg[s:e], ':')+1 : e]))
+	if len(hbody) != 2 {
+		return msg
+	}
+	return SIPReplaceRange(msg, s, e, []byte("CSeq: "+hbody[0]+" "+method))
+}
+
+//
+// SIPSetRURI - return a copy of the SIP request with the Request-URI in the
+// first line replaced by uri
+func SIPSetRURI(msg []byte, uri string) []byte {
+	s := bytes.IndexByte(msg, ' ')
+	if s < 0 {
+		return msg
+	}
+	e := bytes.IndexByte(msg[s+1:], ' ')
+	if e < 0 {
+		return msg
+	}
+	return SIPReplaceRange(msg, s+1, s+1+e, []byte(uri))
+}
+
+//
+// SIPFixContact - return a copy of the SIP message with the host and port of
+// the Contact URI replaced by the local address and with transport=ws
+func SIPFixContact(msg []byte, laddr net.Addr) []byte {
+	us, ue := SIPContactBounds(msg)
+	if us < 0 {
+		return msg
+	}
+	uri := string(msg[us:ue])
+	hs, he := SIPURIHostBounds(uri)
+	if hs < 0 {
+		return msg
+	}
+	rest := uri[he:]
+	uhdrs := ""
+	if p := strings.Index(rest, "?"); p >= 0 {
+		uhdrs = rest[p:]
+		rest = rest[:p]
+	}
+	params := ""
+	for _, prm := range strings.Split(rest, ";") {
+		if prm != "" && !strings.HasPrefix(strings.ToLower(prm), "transport=") {
+			params += ";" + prm
+		}
+	}
+	nuri := uri[:hs] + laddr.String() + params + ";transport=ws" + uhdrs
+	PrintMsg("Contact URI rewritten: %s => %s\n", uri, nuri)
+	return SIPReplaceRange(msg, us, ue, []byte(nuri))
+}
+
+//
+// FollowSIPRedirects - while the response is a 3xx, resend the SIP request
+// to the URI of its Contact header, up to sipMaxRedirects times - return the
+// last sent request and the last received response
+func FollowSIPRedirects(ws *websocket.Conn, wmsg []byte, rmsg []byte) ([]byte, []byte) {
+	for hop := 1; hop <= sipMaxRedirects; hop++ {
+		code := SIPStatusCode(rmsg)
+		if code < 300 || code > 399 {
+			break
+		}
+		us, ue := SIPContactBounds(rmsg)
+		if us < 0 {
+			PrintMsg("Redirect response without Contact header - not following\n")
+			break
+		}
+		uri := string(rmsg[us:ue])
+		PrintMsg("Redirect hop %d (%d) to: %s\n", hop, code, uri)
+		wmsg = SIPSetRURI(SIPNewViaBranch(SIPIncCSeq(wmsg)), uri)
+		err := SendData(ws, wmsg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		PrintMsg("Resending (%d bytes):\n[[%s]]\n", len(wmsg), DisplayData(wmsg))
+		PrintRequest(wmsg)
+		rmsg, err = RecvData(ws)
+		if err != nil {
+			FatalRecvError(err)
+		}
+		PrintRecvData(fmt.Sprintf("Receiving (%d bytes):", len(rmsg)), rmsg)
+	}
+	return wmsg, rmsg
+}
+
+//
+// ManageSIPResponse - process a SIP response
+// - if was a 401/407, follow up with authentication request
+// - return the last received response and true if it was processed
+func ManageSIPResponse(ws *websocket.Conn, wmsg []byte, rmsg []byte) ([]byte, bool) {
+	if cliops.wsapasswd == "" {
+		return rmsg, false
+	}
+	// www or proxy authentication
+	hname := ""
+	switch SIPStatusCode(rmsg) {
+	case 401:
+		hname = "WWW-Authenticate"
+	case 407:
+		hname = "Proxy-Authenticate"
+	default:
+		return rmsg, false
+	}
+	hparams := ChooseAuthChallenge(SIPHeaderValues(unfoldHeaders(rmsg), hname))
+	if hparams == nil {
+		return rmsg, false
+	}
+	auser := "test"
+	if cliops.wsauser != "" {
+		auser = cliops.wsauser
+	}
+
+	s := strings.SplitN(string(wmsg), " ", 3)
+	if len(s) != 3 {
+		return rmsg, false
+	}
+
+	hparams["method"] = s[0]
+	hparams["uri"] = s[1]
+	PrintMsg("\n")
+	PrintMsg("Auth params map:\n    %+v\n\n", hparams)
+	authResponse := BuildAuthResponseHeader(auser, cliops.wsapasswd, hparams)
+	stats.AddAuthChallenge()
+
+	// build new request - increase CSeq and insert auth header after it
+	// (the other headers, like Route, are kept in place)
+	if n, _ := SIPHeaderBounds(wmsg, "CSeq"); n < 0 {
+		return rmsg, false
+	}
+	wmsg = SIPIncCSeq(wmsg)
+	n := SIPAuthInsertPos(wmsg)
+	var obuf bytes.Buffer
+	obuf.Write(wmsg[:n])
+	if hname[0] == 'W' {
+		obuf.WriteString("\r\nAuthorization: ")
+	} else {
+		obuf.WriteString("\r\nProxy-Authorization: ")
+	}
+	obuf.WriteString(authResponse)
+	obuf.Write(wmsg[n:])
 
 	// sending data to ws server
-	_, err := ws.Write(obuf.Bytes())
+	err := SendData(ws, obuf.Bytes())
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Printf("Resending (%d bytes):\n[[%s]]\n", obuf.Len(), obuf.Bytes())
+	PrintMsg("Resending (%d bytes):\n[[%s]]\n", obuf.Len(), DisplayData(obuf.Bytes()))
+	PrintRequest(obuf.Bytes())
 
 	// receive data from ws server
 	if cliops.wsreceive {
-		var imsg = make([]byte, 8192)
-		n, err := ws.Read(imsg)
+		imsg, err := RecvData(ws)
 		if err != nil {
-			log.Fatal(err)
+			FatalRecvError(err)
 		}
-		fmt.Printf("Receiving: (%d bytes)\n[[%s]]\n", n, imsg)
+		PrintRecvData(fmt.Sprintf("Receiving: (%d bytes)", len(imsg)), imsg)
+		return imsg, true
 	}
 
-	return true
+	return nil, true
 }
@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// newEchoServer - start a websocket server sending back each message, the
+// received messages being written to the channel
+func newEchoServer(t *testing.T, recv chan<- string) *httptest.Server {
+	srv := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		for {
+			var msg string
+			if err := websocket.Message.Receive(ws, &msg); err != nil {
+				return
+			}
+			recv <- msg
+			websocket.Message.Send(ws, msg)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// dialTestServer - open a websocket connection to the test server
+func dialTestServer(t *testing.T, srv *httptest.Server) (*websocket.Conn, func() (*websocket.Conn, error)) {
+	cfg, err := websocket.NewConfig(strings.Replace(srv.URL, "http://", "ws://", 1), "http://127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	redial := func() (*websocket.Conn, error) {
+		return WSDial(cfg)
+	}
+	ws, err := redial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws, redial
+}
+
+func TestIsSIPResponse(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want bool
+	}{
+		{"SIP/2.0", false},
+		{"SIP/2.0 20", false},
+		{"SIP/2.0 2000", false},
+		{"SIP/2.0 200", true},
+		{"SIP/2.0 200 OK", true},
+		{"SIP/2.0 200 OK\r\nCSeq: 1 OPTIONS\r\n\r\n", true},
+		{"SIP/2.0 200\r\n", true},
+		{"SIP/2.0 2x0 OK", false},
+		{"OPTIONS sip:alice@example.com SIP/2.0\r\nCSeq: 1 OPTIONS\r\n\r\n", false},
+	}
+	for _, tt := range tests {
+		if got := isSIPResponse([]byte(tt.msg)); got != tt.want {
+			t.Errorf("isSIPResponse(%q) = %v, want %v", tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestTemplateSeqPerConnection(t *testing.T) {
+	// the counter restarts for each connection of a scenario run with redial
+	sdir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(sdir, "step.tpl"), []byte("seq={{seq}},{{seq}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	steps := []ScenarioStep{{Template: "step.tpl"}, {Template: "step.tpl"}, {Template: "step.tpl"}}
+	for _, tt := range []struct {
+		name   string
+		redial bool
+		want   []string
+	}{
+		{"same connection", false, []string{"seq=1,2", "seq=3,4", "seq=5,6"}},
+		{"new connections", true, []string{"seq=1,2", "seq=1,2", "seq=1,2"}},
+	} {
+		recv := make(chan string, len(steps))
+		srv := newEchoServer(t, recv)
+		ws, redial := dialTestServer(t, srv)
+		if !tt.redial {
+			redial = nil
+		}
+		ws = RunScenario(ws, redial, steps, sdir, nil, NewTemplateFuncs())
+		ws.Close()
+		for i, want := range tt.want {
+			if got := <-recv; got != want {
+				t.Errorf("%s: step %d sent %q, want %q", tt.name, i+1, got, want)
+			}
+		}
+	}
+}
+
+func TestBenchReceive(t *testing.T) {
+	ocliops := cliops
+	defer func() { cliops = ocliops }()
+	cliops.wsproto = "sip"
+	req := "OPTIONS sip:bob@example.com SIP/2.0\r\nVia: SIP/2.0/WS h.invalid;branch=z9hG4bK%[1]d\r\n" +
+		"CSeq: %[1]d OPTIONS\r\nContent-Length: 0\r\n\r\n"
+	rpl := "SIP/2.0 %[2]s\r\nVia: SIP/2.0/WS h.invalid;branch=z9hG4bK%[1]d\r\n" +
+		"CSeq: %[1]d OPTIONS\r\nContent-Length: 0\r\n\r\n"
+	tests := []struct {
+		name  string
+		tmout int
+		rpls  []string
+		nrecv int
+		nlost int
+	}{
+		{"out of order", 2000, []string{fmt.Sprintf(rpl, 1, "100 Trying"), fmt.Sprintf(rpl, 3, "200 OK"),
+			fmt.Sprintf(rpl, 9, "200 OK"), fmt.Sprintf(rpl, 1, "200 OK"), fmt.Sprintf(rpl, 2, "404 Not Found")}, 3, 0},
+		{"partly answered", 200, []string{fmt.Sprintf(rpl, 2, "200 OK")}, 1, 2},
+		{"no response", 200, nil, 0, 3},
+	}
+	for _, tt := range tests {
+		cliops.wstimeoutrecv = tt.tmout
+		srv := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+			for i := 0; i < 3; i++ {
+				var msg string
+				if err := websocket.Message.Receive(ws, &msg); err != nil {
+					return
+				}
+			}
+			for _, r := range tt.rpls {
+				websocket.Message.Send(ws, r)
+			}
+			// keep the connection open until the client closes it
+			var msg string
+			websocket.Message.Receive(ws, &msg)
+		}))
+		ws, _ := dialTestServer(t, srv)
+		slots := make(chan struct{}, 3)
+		sentc := make(chan benchPending, 3)
+		for i := 1; i <= 3; i++ {
+			slots <- struct{}{}
+			sentc <- benchPending{cseq: i, tsend: time.Now()}
+			if err := SendData(ws, []byte(fmt.Sprintf(req, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		close(sentc)
+		times, nlost := BenchReceive(ws, sentc, slots)
+		ws.Close()
+		srv.Close()
+		if times.n != tt.nrecv || nlost != tt.nlost || len(slots) != 0 {
+			t.Errorf("%s: BenchReceive() = %d responses, %d lost, %d slots taken - want %d, %d, 0",
+				tt.name, times.n, nlost, len(slots), tt.nrecv, tt.nlost)
+		}
+	}
+}
+
+func TestTemplateURLQueryRoundTrip(t *testing.T) {
+	tests := []struct {
+		in      string
+		escaped string
+	}{
+		{"alice smith@example.com", "alice%20smith%40example.com"},
+		{"a+b c", "a%2Bb%20c"},
+		{"plain", "plain"},
+	}
+	for _, tt := range tests {
+		out, err := RenderTemplate(`{{urlquery .v}}|{{urlunescape (urlquery .v)}}`, ".",
+			map[string]string{"v": tt.in}, NewTemplateFuncs())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := tt.escaped + "|" + tt.in; string(out) != want {
+			t.Errorf("urlquery/urlunescape(%q) = %q, want %q", tt.in, out, want)
+		}
+	}
+}
+
+func TestAuthUserhash(t *testing.T) {
+	// RFC 7616 section 3.9.2 with the userhash value fixed by erratum 4897
+	// (the RFC text has 488869477bf257147b804c45308cd62ac4e25eb717b12b298c79e62dcea254ec)
+	hparams := map[string]string{
+		"realm":     "api@example.org",
+		"nonce":     "5TsQWLVdgBdmrQ0XsxbDODV+57QdFR34I9HAbC/RVvkK",
+		"algorithm": "SHA-512-256",
+		"userhash":  "true",
+		"method":    "GET",
+		"uri":       "/doe.json",
+	}
+	want := `username="793263caabb707a56211940d90411ea4a575adeccb7e360aeb624ed06ece9b0b"`
+	hdr := BuildAuthResponseHeader("Jäsøn Doe", "Secret, or not?", hparams)
+	if !strings.Contains(hdr, want) || !strings.Contains(hdr, "userhash=true") {
+		t.Errorf("BuildAuthResponseHeader() = %q, want %s and userhash=true", hdr, want)
+	}
+}
+
+func TestDigestHA1Sess(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		sess      bool
+		want      string
+	}{
+		// H(H(alice:example.com:secret):n0nce:c0nce)
+		{"MD5", true, "9ea4dffcb72f14015eba9e393c8cd034"},
+		{"SHA-256", true, "62135e45a7cdbad805a946fb9a6fcaca4a732dc56da4d0e9622463e2a83a3834"},
+		// H(alice:example.com:secret)
+		{"MD5", false, HDigest("MD5", "alice:example.com:secret")},
+	}
+	for _, tt := range tests {
+		if got := DigestHA1(tt.algorithm, tt.sess, "alice", "example.com", "secret", "n0nce", "c0nce"); got != tt.want {
+			t.Errorf("DigestHA1(%s, sess=%v) = %s, want %s", tt.algorithm, tt.sess, got, tt.want)
+		}
+	}
+
+	// the response of the session variant is computed with the cnonce sent
+	hparams := map[string]string{"realm": "example.com", "nonce": "n0nce", "algorithm": "SHA-256-sess",
+		"method": "REGISTER", "uri": "sip:example.com"}
+	hdr := BuildAuthResponseHeader("alice", "secret", hparams)
+	rparams := ParseAuthHeader([]byte(hdr))
+	HA1 := DigestHA1("SHA-256", true, "alice", "example.com", "secret", "n0nce", rparams["cnonce"])
+	HA2 := HDigest("SHA-256", "REGISTER:sip:example.com")
+	if want := HDigest("SHA-256", HA1+":n0nce:"+HA2); rparams["response"] != want || rparams["algorithm"] != "SHA-256-sess" {
+		t.Errorf("BuildAuthResponseHeader() = %q, want algorithm=SHA-256-sess and response=%s", hdr, want)
+	}
+}
+
+func TestUnfoldHeadersAuth(t *testing.T) {
+	msg := "SIP/2.0 401 Unauthorized\r\n" +
+		"Via: SIP/2.0/WSS df7jal23ls0d.invalid;branch=z9hG4bK1\r\n" +
+		"WWW-Authenticate: Digest\r\n" +
+		" realm=\"example.com\",\r\n" +
+		"\tnonce=\"a1b2c3d4\",\r\n" +
+		" \t algorithm=MD5\r\n" +
+		"CSeq: 1 REGISTER\r\n" +
+		"Content-Length: 6\r\n" +
+		"\r\n" +
+		" body\n"
+	umsg := unfoldHeaders([]byte(msg))
+	if want := "WWW-Authenticate: Digest realm=\"example.com\", nonce=\"a1b2c3d4\", algorithm=MD5\r\nCSeq:"; !strings.Contains(string(umsg), want) {
+		t.Errorf("unfoldHeaders() = %q, want it to contain %q", umsg, want)
+	}
+	if !strings.HasSuffix(string(umsg), "\r\n\r\n body\n") {
+		t.Errorf("unfoldHeaders() = %q, body changed", umsg)
+	}
+	vals := SIPHeaderValues(umsg, "WWW-Authenticate")
+	if len(vals) != 1 {
+		t.Fatalf("SIPHeaderValues() = %q, want one value", vals)
+	}
+	hparams := ParseAuthHeader([]byte(vals[0]))
+	if hparams["realm"] != "example.com" || hparams["nonce"] != "a1b2c3d4" || hparams["algorithm"] != "MD5" {
+		t.Errorf("ParseAuthHeader(%q) = %v, want realm example.com, nonce a1b2c3d4, algorithm MD5", vals[0], hparams)
+	}
+}
+
+func TestSIPCompactHeaders(t *testing.T) {
+	msg := []byte("OPTIONS sip:bob@example.com SIP/2.0\r\n" +
+		"v: SIP/2.0/WSS df7jal23ls0d.invalid;branch=z9hG4bKold;rport\r\n" +
+		"f: <sip:alice@example.com>;tag=a1\r\n" +
+		"t: <sip:bob@example.com>\r\n" +
+		"i: c4ll1d@wsctl.invalid\r\n" +
+		"CSeq: 1 OPTIONS\r\n" +
+		"m: <sip:alice@df7jal23ls0d.invalid;transport=ws>\r\n" +
+		"l: 0\r\n" +
+		"\r\n")
+
+	nmsg := SIPNewViaBranch(msg)
+	s, e := SIPHeaderBounds(nmsg, "Via")
+	if s < 0 || !strings.HasPrefix(string(nmsg[s:e]), "v: SIP/2.0/WSS df7jal23ls0d.invalid;branch=z9hG4bK") ||
+		strings.Contains(string(nmsg[s:e]), "z9hG4bKold") || !strings.HasSuffix(string(nmsg[s:e]), ";rport") {
+		t.Errorf("SIPNewViaBranch() = %q, want a new branch in the compact via header", nmsg)
+	}
+
+	if vals := SIPHeaderValues(msg, "Call-ID"); len(vals) != 1 || vals[0] != "c4ll1d@wsctl.invalid" {
+		t.Errorf("SIPHeaderValues(Call-ID) = %q, want [c4ll1d@wsctl.invalid]", vals)
+	}
+	if rmsg := SIPBuildResponse(msg, "200 OK"); !strings.Contains(string(rmsg), "\r\nCall-ID: c4ll1d@wsctl.invalid\r\n") {
+		t.Errorf("SIPBuildResponse() = %q, want the Call-ID of the compact header", rmsg)
+	}
+
+	nmsg = SIPFixContact(msg, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000})
+	if want := "\r\nm: <sip:alice@192.0.2.1:40000;transport=ws>\r\n"; !strings.Contains(string(nmsg), want) {
+		t.Errorf("SIPFixContact() = %q, want it to contain %q", nmsg, want)
+	}
+
+	nmsg, err := SIPAttachBody(msg, []byte("v=0\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(nmsg), "\r\nContent-Length: 5\r\n\r\nv=0\r\n") || strings.Contains(string(nmsg), "\r\nl: ") {
+		t.Errorf("SIPAttachBody() = %q, want the compact Content-Length replaced", nmsg)
+	}
+}
+
+func TestSIPAuthInsertPos(t *testing.T) {
+	const req = "REGISTER sip:example.com SIP/2.0\r\n"
+	tests := []struct {
+		name string
+		hdrs string
+		want string
+	}{
+		{"cseq only", "Via: v\r\nCSeq: 2 REGISTER\r\nTo: t\r\n",
+			"Via: v\r\nCSeq: 2 REGISTER\r\nAuthorization: A\r\nTo: t\r\n"},
+		{"cseq last", "Via: v\r\nCSeq: 2 REGISTER\r\n",
+			"Via: v\r\nCSeq: 2 REGISTER\r\nAuthorization: A\r\n"},
+		{"routes after cseq", "Via: v\r\nCSeq: 2 REGISTER\r\nRoute: <sip:p1;lr>\r\nroute: <sip:p2;lr>,\r\n <sip:p3;lr>\r\nTo: t\r\n",
+			"Via: v\r\nCSeq: 2 REGISTER\r\nRoute: <sip:p1;lr>\r\nroute: <sip:p2;lr>,\r\n <sip:p3;lr>\r\nAuthorization: A\r\nTo: t\r\n"},
+		{"record-route after cseq", "CSeq: 2 REGISTER\r\nRecord-Route: <sip:p1;lr>\r\n",
+			"CSeq: 2 REGISTER\r\nRecord-Route: <sip:p1;lr>\r\nAuthorization: A\r\n"},
+		{"route before cseq", "Route: <sip:p1;lr>\r\nCSeq: 2 REGISTER\r\nTo: t\r\n",
+			"Route: <sip:p1;lr>\r\nCSeq: 2 REGISTER\r\nAuthorization: A\r\nTo: t\r\n"},
+	}
+	for _, tt := range tests {
+		msg := []byte(req + tt.hdrs + "\r\n")
+		n := SIPAuthInsertPos(msg)
+		if n < 0 {
+			t.Errorf("%s: SIPAuthInsertPos() = %d", tt.name, n)
+			continue
+		}
+		got := string(msg[:n]) + "\r\nAuthorization: A" + string(msg[n:])
+		if want := req + tt.want + "\r\n"; got != want {
+			t.Errorf("%s: auth header inserted as %q, want %q", tt.name, got, want)
+		}
+	}
+	if n := SIPAuthInsertPos([]byte(req + "Via: v\r\n\r\n")); n != -1 {
+		t.Errorf("SIPAuthInsertPos() without CSeq = %d, want -1", n)
+	}
+}
+
+// acceptHandshake - read the websocket handshake request on the connection,
+// returning its raw header lines, and reply accepting it with the requested
+// sub-protocol
+func acceptHandshake(conn net.Conn) ([]string, error) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	var lines []string
+	key, proto := "", ""
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return lines, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		lines = append(lines, line)
+		if p := strings.Index(line, ":"); p > 0 {
+			switch strings.ToLower(line[:p]) {
+			case "sec-websocket-key":
+				key = strings.TrimSpace(line[p+1:])
+			case "sec-websocket-protocol":
+				proto = strings.TrimSpace(line[p+1:])
+			}
+		}
+	}
+	h := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	rpl := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(h[:]) + "\r\n"
+	if proto != "" {
+		rpl += "Sec-WebSocket-Protocol: " + proto + "\r\n"
+	}
+	_, err := conn.Write([]byte(rpl + "\r\n"))
+	return lines, err
+}
+
+func TestWSProtocolAdvertised(t *testing.T) {
+	tests := []struct {
+		proto string
+		want  []string
+	}{
+		{"sip", []string{"Sec-WebSocket-Protocol: sip"}},
+		{"SIP", []string{"Sec-WebSocket-Protocol: SIP"}},
+		{"Sip", []string{"Sec-WebSocket-Protocol: Sip"}},
+		{"msrp", []string{"Sec-WebSocket-Protocol: msrp"}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdrs := make(chan []string, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				hdrs <- nil
+				return
+			}
+			lines, _ := acceptHandshake(conn)
+			hdrs <- lines
+		}()
+		cfg, err := websocket.NewConfig("ws://"+ln.Addr().String()+"/", "http://127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Protocol = WSProtocols(tt.proto)
+		ws, err := WSDial(cfg)
+		if err != nil {
+			t.Errorf("proto %q: WSDial() error: %v", tt.proto, err)
+		} else {
+			ws.Close()
+		}
+		ln.Close()
+		var got []string
+		for _, line := range <-hdrs {
+			if strings.HasPrefix(strings.ToLower(line), "sec-websocket-protocol:") {
+				got = append(got, line)
+			}
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("proto %q: handshake protocol headers = %q, want %q", tt.proto, got, tt.want)
+		}
+	}
+}
+
+// readFrame - read a masked frame from the connection, returning its first
+// header byte and the unmasked payload
+func readFrame(conn net.Conn) (byte, []byte, error) {
+	fhdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, fhdr); err != nil {
+		return 0, nil, err
+	}
+	if hlen := FrameHeaderLen(fhdr); hlen > 2 {
+		fhdr = append(fhdr, make([]byte, hlen-2)...)
+		if _, err := io.ReadFull(conn, fhdr[2:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, FramePayloadLen(fhdr))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return 0, nil, err
+	}
+	if fhdr[1]&0x80 != 0 {
+		mkey := fhdr[len(fhdr)-4:]
+		for i := range payload {
+			payload[i] ^= mkey[i%4]
+		}
+	}
+	return fhdr[0], payload, nil
+}
+
+func TestWSWriteFrameHighBitBytes(t *testing.T) {
+	hbytes := make([]byte, 0, 128)
+	for b := 0x80; b <= 0xff; b++ {
+		hbytes = append(hbytes, byte(b))
+	}
+	tests := []struct {
+		name    string
+		fin     bool
+		opcode  byte
+		payload []byte
+	}{
+		{"all high-bit bytes", true, websocket.BinaryFrame, hbytes},
+		{"short payload", true, websocket.BinaryFrame, hbytes[:100]},
+		{"first fragment", false, websocket.BinaryFrame, hbytes[100:]},
+		{"continuation", true, websocket.ContinuationFrame, []byte{0xff, 0xfe, 0x80, 0x00}},
+		{"long payload", true, websocket.BinaryFrame, bytes.Repeat(hbytes, 600)},
+	}
+	oconn := wsconn
+	defer func() { wsconn = oconn }()
+	for _, tt := range tests {
+		cconn, sconn := net.Pipe()
+		wsconn = cconn
+		errc := make(chan error, 1)
+		go func() {
+			errc <- WSWriteFrame(tt.fin, tt.opcode, tt.payload)
+		}()
+		b0, payload, err := readFrame(sconn)
+		if err != nil {
+			t.Fatalf("%s: reading the frame: %v", tt.name, err)
+		}
+		if err = <-errc; err != nil {
+			t.Fatalf("%s: WSWriteFrame() error: %v", tt.name, err)
+		}
+		cconn.Close()
+		sconn.Close()
+		want := tt.opcode
+		if tt.fin {
+			want |= 0x80
+		}
+		if b0 != want {
+			t.Errorf("%s: first header byte = %#x, want %#x", tt.name, b0, want)
+		}
+		if !bytes.Equal(payload, tt.payload) {
+			t.Errorf("%s: payload = % x, want % x", tt.name, payload, tt.payload)
+		}
+	}
+}
+
+func TestParseFieldsData(t *testing.T) {
+	tests := []struct {
+		name  string
+		fpath string
+		data  string
+		want  interface{}
+	}{
+		{"json", "fields.json", `{"user": "alice", "port": 5060, "codecs": ["opus", "pcmu"]}`,
+			map[string]interface{}{"user": "alice", "port": float64(5060), "codecs": []interface{}{"opus", "pcmu"}}},
+		{"json by content", "fields", ` [{"user": "alice"}]`,
+			[]interface{}{map[string]interface{}{"user": "alice"}}},
+		{"yaml", "fields.yaml", "# test fields\n---\nuser: alice # the caller\n" +
+			"display: \"Alice # Smith\"\nquote: 'it''s'\nport: 5060\ncodecs: [opus, \"pcmu\"]\nroutes:\n  - sip:p1\n  - 'sip:p2'\n",
+			map[string]interface{}{"user": "alice", "display": "Alice # Smith", "quote": "it's", "port": "5060",
+				"codecs": []interface{}{"opus", "pcmu"}, "routes": []interface{}{"sip:p1", "sip:p2"}}},
+		{"yaml by content", "fields.txt", "user: alice\r\ndomain: example.com\r\n",
+			map[string]interface{}{"user": "alice", "domain": "example.com"}},
+		{"properties", "fields.properties", "# test fields\n! comment\nuser = alice\nuri=sip:alice@example.com;transport=ws\n",
+			map[string]interface{}{"user": "alice", "uri": "sip:alice@example.com;transport=ws"}},
+		{"properties by content", "fields.gz", "user=alice\nurl=http://example.com/a=b\n",
+			map[string]interface{}{"user": "alice", "url": "http://example.com/a=b"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseFieldsData(tt.fpath, []byte(tt.data))
+		if err != nil {
+			t.Errorf("%s: ParseFieldsData() error: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ParseFieldsData() = %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+
+	etests := []struct {
+		name  string
+		fpath string
+		data  string
+		want  string
+	}{
+		{"bad json", "fields.json", `{"user": "alice",`,
+			"failed to parse fields file fields.json as json: unexpected end of JSON input"},
+		{"nested yaml", "fields.yaml", "sip:\n  user: alice\n",
+			"failed to parse fields file fields.yaml - not json, yaml (line 2: nested mappings are not supported) or key=value properties (line 1: expected 'key=value')"},
+		{"no fields", "fields.properties", "# only a comment\n",
+			"failed to parse fields file fields.properties - not json, yaml (no fields) or key=value properties (no fields)"},
+	}
+	for _, tt := range etests {
+		_, err := ParseFieldsData(tt.fpath, []byte(tt.data))
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%s: ParseFieldsData() error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestRenderTemplateNoEscaping(t *testing.T) {
+	const val = `<sip:a@b>;tag="x&y"`
+	tests := []struct {
+		name   string
+		tplstr string
+	}{
+		{"literal", `<sip:a@b>;tag="x&y"`},
+		{"field", `{{.v}}`},
+		{"printf", `{{printf "%s" .v}}`},
+		{"quoted parts", `<sip:a@b>;tag="{{.tag}}"`},
+	}
+	for _, tt := range tests {
+		out, err := RenderTemplate(tt.tplstr, ".", map[string]string{"v": val, "tag": "x&y"}, NewTemplateFuncs())
+		if err != nil {
+			t.Errorf("%s: RenderTemplate() error: %v", tt.name, err)
+			continue
+		}
+		if string(out) != val {
+			t.Errorf("%s: RenderTemplate() = %q, want %q", tt.name, out, val)
+		}
+	}
+}
+
+func TestHealthcheckTemplateDelims(t *testing.T) {
+	oleft, oright := tplDelimLeft, tplDelimRight
+	defer func() { tplDelimLeft, tplDelimRight = oleft, oright }()
+	for _, delims := range [][2]string{{"{{", "}}"}, {"[[", "]]"}} {
+		tplDelimLeft, tplDelimRight = delims[0], delims[1]
+		out, err := RenderTemplate(HealthcheckMessage("example.com"), ".", map[string]string{"sipdomain": "example.com"}, NewTemplateFuncs())
+		if err != nil {
+			t.Errorf("%s %s: RenderTemplate() error: %v", delims[0], delims[1], err)
+			continue
+		}
+		for _, want := range []string{"OPTIONS sip:example.com SIP/2.0\r\n",
+			"From: <sip:healthcheck@example.com>;tag=", "To: <sip:example.com>\r\n"} {
+			if !strings.Contains(string(out), want) {
+				t.Errorf("%s %s: healthcheck = %q, missing %q", delims[0], delims[1], out, want)
+			}
+		}
+	}
+}
+
+func TestChooseAuthChallenge(t *testing.T) {
+	md5chal := `Digest realm="example.com", nonce="n1", algorithm=MD5`
+	nalgchal := `Digest realm="example.com", nonce="n1"`
+	sha256chal := `Digest realm="example.com", nonce="n2", algorithm=SHA-256`
+	tests := []struct {
+		name   string
+		prefer []string
+		hvals  []string
+		want   string
+	}{
+		{"default prefers sha-256", authPreference, []string{md5chal, sha256chal}, "n2"},
+		{"default prefers sha-256 (first)", authPreference, []string{sha256chal, md5chal}, "n2"},
+		{"no algorithm is md5", authPreference, []string{nalgchal, sha256chal}, "n2"},
+		{"md5 preferred", []string{"MD5", "SHA-256"}, []string{sha256chal, md5chal}, "n1"},
+		{"no algorithm preferred as md5", []string{"MD5"}, []string{sha256chal, nalgchal}, "n1"},
+		{"preference absent", []string{"SHA-512-256"}, []string{md5chal, sha256chal}, "n1"},
+		{"preference absent (sha-256 first)", []string{"SHA-512-256"}, []string{sha256chal, md5chal}, "n2"},
+		{"preference partly absent", []string{"SHA-512-256", "SHA-256"}, []string{md5chal, sha256chal}, "n2"},
+		{"not digest skipped", authPreference, []string{`Basic realm="example.com"`, md5chal}, "n1"},
+		{"no digest", authPreference, []string{`Basic realm="example.com"`}, ""},
+	}
+	opref := authPreference
+	defer func() { authPreference = opref }()
+	for _, tt := range tests {
+		authPreference = tt.prefer
+		hparams := ChooseAuthChallenge(tt.hvals)
+		if hparams["nonce"] != tt.want || (tt.want == "" && hparams != nil) {
+			t.Errorf("%s: ChooseAuthChallenge() = %v, want the challenge with nonce %q", tt.name, hparams, tt.want)
+		}
+	}
+}